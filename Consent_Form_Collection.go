@@ -1,12 +1,29 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"strings"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 	"encoding/json"
 	"regexp"
+	"strconv"
+	"sort"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"encoding/hex"
+	"unicode/utf8"
+	"github.com/kkoiwai/ConsentForm/envelope"
+	"github.com/kkoiwai/ConsentForm/events"
 )
 
 
@@ -28,247 +45,1390 @@ type CustRef_Holder struct {
 	CustRefs 	[]CustRef `json:"custrefs"`
 }
 
+// Registered entity. KeyId is the envelope key ID of EntityPublicKey, which has been current since KeyValidFrom;
+// PreviousKeys are the keys rotate_entity_key replaced, oldest first. Entities registered before key rotation have
+// neither KeyId nor KeyValidFrom until their record is next written.
+// Roles are ROLE_ constants, sorted; entities registered before roles have none and hold DEFAULT_ROLES.
 type Entity struct {
 	EntityId  string `json:"entity_id"`
 	EntityName string `json:"entity_name"`
 	EntityPublicKey string `json:"entity_public_key"`
+	Roles []string `json:"roles,omitempty"`
+	KeyId string `json:"key_id,omitempty"`
+	KeyValidFrom int64 `json:"key_valid_from,omitempty"`
+	PreviousKeys []EntityKey `json:"previous_keys,omitempty"`
+}
+
+// A public key an entity used before rotating to a new one, current from ValidFrom until ValidUntil.
+// Data encrypted to it is listed by get_records_by_key_id until its senders have re-submitted it.
+type EntityKey struct {
+	KeyId string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	ValidFrom int64 `json:"valid_from"`
+	ValidUntil int64 `json:"valid_until"`
 }
 type Entity_Holder struct {
 	Entities []Entity `json:"entities"`
+	Next string `json:"next,omitempty"`
+}
+
+// Snapshot of every registered entity, made by export_entities and loaded by import_entities to give another channel
+// the same membership. Count is the number of Entities, to tell a truncated snapshot.
+type EntityDirectory struct {
+	ExportedBy string `json:"exported_by"`
+	ExportedAt int64 `json:"exported_at"`
+	TxId string `json:"tx_id"`
+	Count int `json:"count"`
+	Entities []Entity `json:"entities"`
+}
+
+// Result of import_entities, by entity ID. Unchanged entities were already registered with the same record.
+type EntityImportReport struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
 }
 
+// Customer data as returned by the query functions. Content is the JSON submitted by the sender, returned as is;
+// content that is not valid JSON is returned as a JSON string with Opaque set. Only get_customer_content returns
+// Content, and only under an access record access_customer committed before, so that every read of it is recorded;
+// the other queries leave it out.
+// Version, RegisteredAt and TxId describe the latest version and are 0/empty for data registered before versioning.
 type CustomerData struct {
 	CustomerId  string `json:"customer_id"`
 	SenderId string `json:"sender_id"`
 	ReceiverId string `json:"receiver_id"`
-	Content string `json:"content"`
+	Version int `json:"version"`
+	RegisteredAt int64 `json:"registered_at"`
+	TxId string `json:"tx_id,omitempty"`
+	KeyId string `json:"key_id,omitempty"`
+	Opaque bool `json:"opaque,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
 }
 type CustomerData_Holder struct {
 	Entries []CustomerData `json:"entries"`
+	Next string `json:"next,omitempty"`
+}
+
+// One entry of register_customers_batch. Content is the envelope, as json_data is for register_customer.
+type CustomerBatchEntry struct {
+	CustomerId string `json:"customer_id"`
+	ReceiverId string `json:"receiver_id"`
+	SenderId string `json:"sender_id"`
+	Content json.RawMessage `json:"content"`
+	TemplateId string `json:"template_id,omitempty"`
+	TemplateVersion string `json:"template_version,omitempty"`
+}
+
+// Result of one entry of register_customers_batch: the version written, or why the entry was rejected.
+type CustomerBatchResult struct {
+	CustomerId string `json:"customer_id"`
+	ReceiverId string `json:"receiver_id"`
+	SenderId string `json:"sender_id"`
+	Version int `json:"version,omitempty"`
+	Error *ChaincodeError `json:"error,omitempty"`
+}
+type CustomerBatchResult_Holder struct {
+	Results []CustomerBatchResult `json:"results"`
+}
+
+// One version of the data shared from a sender to a receiver for a customer. Every version is kept under
+// DH/receiver/customer/sender/version and the latest one is also stored under the D/ data key.
+// Data registered before versioning holds the raw content under the D/ key and has Version 0.
+// Content and Opaque follow the same rules as in CustomerData; get_customer_history leaves them out. KeyId is the key
+// ID of the receiver's key the content is encrypted to; the current version is also indexed under
+// KID/receiver/key_id/sender/customer.
+type DataVersion struct {
+	Version int `json:"version"`
+	TxId string `json:"tx_id"`
+	Timestamp int64 `json:"timestamp"`
+	ContentHash string `json:"content_hash"`
+	TemplateId string `json:"template_id,omitempty"`
+	TemplateVersion string `json:"template_version,omitempty"`
+	KeyId string `json:"key_id,omitempty"`
+	Opaque bool `json:"opaque,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+}
+type DataVersion_Holder struct {
+	Versions []DataVersion `json:"versions"`
+	Next string `json:"next,omitempty"`
+}
+
+// Consent form template registered by an admin. Schema is the JSON Schema of the data collected with the form;
+// templates are immutable, a changed form is registered as a new version. Stored under FORM/template_id/version.
+// The data is encrypted, so the ledger only checks field names against the schema, see check_form_fields: the schema
+// is an object with properties, and may only use form_schema_keywords at its top level. What the property schemas
+// say about the values is left to the receiver to check once it decrypted them.
+type FormTemplate struct {
+	TemplateId string `json:"template_id"`
+	Version string `json:"version"`
+	Language string `json:"language"`
+	Schema json.RawMessage `json:"schema"`
+	RegisteredBy string `json:"registered_by"`
+	RegisteredAt int64 `json:"registered_at"`
+}
+
+// The part of a JSON Schema the ledger can check against the fields declared by a content envelope.
+type FormSchema struct {
+	Type string `json:"type"`
+	Properties map[string]json.RawMessage `json:"properties"`
+	Required []string `json:"required"`
+	AdditionalProperties *bool `json:"additionalProperties"`
+}
+
+// Consent given by a customer to share data from a sender to a receiver. Each customer/receiver/sender
+// combination has at most 1 Consent, stored under CONSENT/customer/receiver/sender.
+// GrantedAt, ExpiresAt and RevokedAt are unix seconds taken from the transaction timestamp;
+// ExpiresAt 0 means no expiry, RevokedAt 0 means the consent has not been withdrawn.
+type Consent struct {
+	CustomerId  string `json:"customer_id"`
+	SenderId string `json:"sender_id"`
+	ReceiverId string `json:"receiver_id"`
+	Purpose string `json:"purpose"`
+	Scope string `json:"scope"`
+	GrantedAt int64 `json:"granted_at"`
+	ExpiresAt int64 `json:"expires_at"`
+	RevokedAt int64 `json:"revoked_at"`
+}
+
+// Customer-centric view of where a customer's data flows, built from the CSR/customer/sender/receiver index.
+type SharingFlow struct {
+	SenderId string `json:"sender_id"`
+	ReceiverId string `json:"receiver_id"`
+}
+type SharingMap struct {
+	CustomerId string `json:"customer_id"`
+	Flows []SharingFlow `json:"flows"`
+	Next string `json:"next,omitempty"`
+}
+
+// Proof that a customer's data was erased, stored under ERASURE/customer/txid. It holds no customer data, only who asked
+// for the erasure, when, and how many records went: Records data records with their indexes and history, Crossrefs
+// CUSTREF/ pointers, and ConsentsRevoked consents that were still in force.
+type ErasureCertificate struct {
+	CustomerId string `json:"customer_id"`
+	RequestedBy string `json:"requested_by"`
+	ErasedAt int64 `json:"erased_at"`
+	TxId string `json:"tx_id"`
+	Records int `json:"records"`
+	Crossrefs int `json:"crossrefs"`
+	ConsentsRevoked int `json:"consents_revoked"`
+}
+type ErasureCertificate_Holder struct {
+	Certificates []ErasureCertificate `json:"certificates"`
+	Next string `json:"next,omitempty"`
+}
+
+// Record of one read of a customer's data. Stored under ACCESS/C/customer/time/txid, with a pointer to it
+// under ACCESS/E/accessor/time/txid so that logs can be listed both by customer and by entity.
+type AccessRecord struct {
+	AccessorId string `json:"accessor_id"`
+	CustomerId string `json:"customer_id"`
+	ReceiverId string `json:"receiver_id"`
+	Purpose string `json:"purpose"`
+	AccessedAt int64 `json:"accessed_at"`
+	TxId string `json:"tx_id"`
+}
+type AccessRecord_Holder struct {
+	Entries []AccessRecord `json:"entries"`
+	Next string `json:"next,omitempty"`
+}
+
+// Page of a list query. Every list query takes optional trailing limit and token arguments; Limit 0 means no limit
+// and Token is the "next" value returned with the previous page.
+type Page struct {
+	Limit int
+	Token string
+}
+
+// Chaincode configuration, set by Init and stored under the CONFIG key. IdPattern is the regular expression every
+// customer, entity, crossref and form template ID has to match as a whole. AdminId is the entity allowed to make
+// itself the first admin while no entity holds the admin role.
+type Config struct {
+	IdPattern string `json:"id_pattern"`
+	AdminId string `json:"admin_id,omitempty"`
+}
+
+// Result of one migrate_keys run. Skipped lists the legacy keys that can't be split into IDs unambiguously and are left
+// as they are; More is set when the limit was reached before every legacy key was looked at.
+type MigrationReport struct {
+	Migrated int `json:"migrated"`
+	Skipped []string `json:"skipped"`
+	More bool `json:"more"`
+}
+
+// Discrepancy found by verify_indexes. ObjectType and Ids are those of the key concerned; Problem is one of "missing"
+// (the key should exist but doesn't), "orphan" (the record the key belongs to is gone), "mismatch" (the key points to
+// the wrong record), "duplicate" (a crossref listed for more than one customer, Detail holding the entity and ref) or
+// "stale" (a key ID index key for data now encrypted to another key, Detail holding that key's ID).
+type IndexIssue struct {
+	ObjectType string `json:"object_type"`
+	Ids []string `json:"ids"`
+	Problem string `json:"problem"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// One record of export_state. Type is the object type of Key. Value is the stored value when it is JSON; otherwise,
+// such as for index keys pointing to a record, Opaque is set and Value is the stored value as a JSON string.
+type StateEntry struct {
+	Key string `json:"key"`
+	Type string `json:"type"`
+	Value json.RawMessage `json:"value"`
+	Opaque bool `json:"opaque,omitempty"`
+}
+type StateExport struct {
+	Entries []StateEntry `json:"entries"`
+	Next string `json:"next,omitempty"`
+}
+
+// Result of verify_indexes and repair_indexes. Checked counts the primary records looked at: D/ data records and
+// CUSTID/ holders. Repaired is set when the issues have been fixed in the same transaction.
+type IndexReport struct {
+	Checked int `json:"checked"`
+	Issues []IndexIssue `json:"issues"`
+	Repaired bool `json:"repaired"`
+}
+
+// Error returned by every function routed by Invoke and Query. Code is one of the ERR_ constants below and is stable,
+// so clients can branch on it; Error() returns the JSON encoding of the whole struct.
+type ChaincodeError struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+const (
+	ERR_NOT_FOUND = "NOT_FOUND"				// the requested record does not exist
+	ERR_DUPLICATE = "DUPLICATE"				// the record to register already exists
+	ERR_UNAUTHORIZED = "UNAUTHORIZED"		// the caller, its signature or the customer's consent does not allow the operation
+	ERR_VALIDATION = "VALIDATION"			// the arguments are malformed
+	ERR_CONFLICT = "CONFLICT"				// the operation is not allowed in the current state of the ledger
+	ERR_STORAGE = "STORAGE"					// reading or writing the ledger failed
+	ERR_INTERNAL = "INTERNAL"				// a stored record is corrupt or could not be encoded
+)
+
+const (
+	KEY_SEPARATOR = "\x00"					// separates the object type and attributes of a composite key
+	KEY_MAX = "\U0010FFFF"					// reserved by the shim to close range queries over a partial key
+	DEFAULT_ID_PATTERN = "[A-Za-z0-9][A-Za-z0-9._@:-]{0,127}"
+	MAX_BATCH_SIZE = 1000					// entries per register_customers_batch, which writes eight keys for each
+)
+
+const (
+	ROLE_ADMIN = "admin"							// registers and deletes entities and form templates, repairs the ledger
+	ROLE_DATA_PROVIDER = "data_provider"			// sends customer data
+	ROLE_DATA_CONSUMER = "data_consumer"			// receives customer data
+	ROLE_REGULATOR = "regulator"					// audits the ledger across entities
+	ROLE_CONSENT_MANAGER = "consent_manager"		// grants and revokes consents on behalf of customers
+)
+
+var all_roles = []string{ ROLE_ADMIN, ROLE_CONSENT_MANAGER, ROLE_DATA_CONSUMER, ROLE_DATA_PROVIDER, ROLE_REGULATOR }
+var DEFAULT_ROLES = []string{ ROLE_DATA_CONSUMER, ROLE_DATA_PROVIDER }
+
+// permissions maps a function to the roles that may call it. Functions not listed are open to every registered
+// entity, which still only reach the records they are party to.
+var permissions = map[string][]string{
+	"register_entity": { ROLE_ADMIN },
+	"delete_entity": { ROLE_ADMIN },
+	"import_entities": { ROLE_ADMIN },
+	"register_form_template": { ROLE_ADMIN },
+	"repair_indexes": { ROLE_ADMIN },
+	"migrate_keys": { ROLE_ADMIN },
+	"register_customer": { ROLE_DATA_PROVIDER },
+	"register_customers_batch": { ROLE_DATA_PROVIDER },
+	"delete_customer": { ROLE_DATA_PROVIDER },
+	"grant_consent": { ROLE_CONSENT_MANAGER },
+	"revoke_consent": { ROLE_DATA_PROVIDER, ROLE_DATA_CONSUMER, ROLE_CONSENT_MANAGER },
+	"purge_expired": { ROLE_ADMIN, ROLE_CONSENT_MANAGER },
+	"erase_customer": { ROLE_CONSENT_MANAGER, ROLE_REGULATOR },
+	"access_customer": { ROLE_DATA_CONSUMER },
+	"get_customer_content": { ROLE_DATA_CONSUMER },
+	"get_customer": { ROLE_DATA_CONSUMER },
+	"get_customers_by_receiver_id": { ROLE_DATA_CONSUMER },
+	"get_customers_by_receiver_and_sender": { ROLE_DATA_CONSUMER },
+	"get_customers_by_sender_id": { ROLE_DATA_PROVIDER },
+	"get_customer_by_sender": { ROLE_DATA_PROVIDER },
+	"get_customers_by_sender_and_receiver": { ROLE_DATA_PROVIDER },
+	"get_customer_history": { ROLE_DATA_PROVIDER, ROLE_DATA_CONSUMER },
+	"get_records_by_key_id": { ROLE_DATA_PROVIDER, ROLE_DATA_CONSUMER },
+	"export_state": { ROLE_ADMIN, ROLE_REGULATOR },
+	"get_all_entities": { ROLE_ADMIN, ROLE_REGULATOR },
+	"export_entities": { ROLE_ADMIN, ROLE_REGULATOR },
+	"get_erasure_certificates": { ROLE_REGULATOR },
+	"verify_indexes": { ROLE_ADMIN, ROLE_REGULATOR },
+}
+
+// Keys written before composite keys were "/" separated. legacy_key_ids maps their object types to the number of IDs
+// that follow; legacy_pointer_types are the object types whose values are the legacy key of another record.
+var legacy_key_ids = map[string]int{ "D":3, "SCR":3, "SRC":3, "RSC":3, "CSR":3, "CRS":3, "DH":4, "CONSENT":3, "ACCESS":4, "FORM":2, "ENTID":1, "CUSTID":1, "CUSTREF":2 }
+var object_types = []string{ "ACCESS", "CONFIG", "CONSENT", "CRS", "CSR", "CUSTID", "CUSTREF", "D", "DH", "ENTID", "ERASURE", "FORM", "KID", "RSC", "SCR", "SRC" }
+var legacy_pointer_types = map[string]bool{ "SCR":true, "SRC":true, "RSC":true, "CSR":true, "CRS":true, "CUSTREF":true }
+
+// form_schema_keywords are the keywords a form template schema may use at its top level: those FormSchema holds and
+// annotations. Other keywords, like patternProperties, minProperties or allOf, would constrain the fields in ways
+// check_form_fields can't enforce, so schemas using them are refused rather than silently not enforced.
+var form_schema_keywords = map[string]bool{ "$schema":true, "$id":true, "$comment":true, "title":true, "description":true,
+	"type":true, "properties":true, "required":true, "additionalProperties":true }
+
+// key IDs are the unpadded base64url SHA-256 of a public key, see envelope.KeyID
+var key_id_pattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+
+func (e *ChaincodeError) Error() string {
+	bytes, _ := json.Marshal(e)
+	return string(bytes)
+}
+
+// new_error returns a ChaincodeError. details, if any, are joined with "; ".
+func new_error(code string, message string, details ...string) error {
+	return &ChaincodeError{ Code:code, Message:message, Details:strings.Join(details, "; ") }
 }
 
 //==============================================================================================================================
-//	Init Function - Called when the user deploys the chaincode
+//	Init Function - Called when the chaincode is instantiated or upgraded. Takes an optional ID pattern to use instead
+//					of DEFAULT_ID_PATTERN and an optional initial admin entity ID; whatever is left out or empty, the
+//					stored value is kept.
+//					The initial admin is the only way to a first admin, so on the Fabric 2.x lifecycle the chaincode
+//					definition has to be approved and committed with --init-required, and its first transaction has to be
+//					an --isInit invoke naming the admin, e.g. '{"Args":["init","","bank1"]}'. Without it, Init never runs
+//					and no entity can ever be registered.
 //==============================================================================================================================
-func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	return response(t.init(shim_stub{stub}, function, args))
+}
+
+func (t *SimpleChaincode) init(stub StubInterface, function string, args []string) ([]byte, error) {
+
+	if len(args) > 2 {
+		fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "INIT: Incorrect number of arguments passed")
+	}
+
+	config, err := get_config(stub)
+	if err != nil { return nil, err }
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		config.IdPattern = args[0]
+	}
+	if len(args) > 1 && len(args[1]) > 0 {
+		config.AdminId = args[1]
+	}
+
+	id_pattern, err := compile_id_pattern(config.IdPattern)
+	if err != nil { return nil, err }
+	if len(config.AdminId) > 0 && !valid_id(id_pattern, config.AdminId) {
+		return nil, new_error(ERR_VALIDATION, "Invalid ID", strconv.Quote(config.AdminId))
+	}
+
+	bytes, err := json.Marshal(config)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Config record") }
+
+	err = stub.PutState(make_key("CONFIG"), bytes)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
 	return nil, nil
 }
 
+//==============================================================================================================================
+//	 Stub Interface
+//==============================================================================================================================
+//	StubInterface - The part of the shim's ChaincodeStubInterface used by this chaincode. Init and Invoke wrap the stub they
+//					are given in a shim_stub; everything they route to works on StubInterface so that it can also be run
+//					against an in-memory stub in tests.
+//==============================================================================================================================
+type StubInterface interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	GetStateByRange(startKey string, endKey string) (StateIterator, error)
+	GetStateByPartialCompositeKey(objectType string, keys []string) (StateIterator, error)
+	GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (StateIterator, string, error)
+	GetTxID() string
+	GetTxTime() (int64, error)
+	GetAttributeValue(attrName string) (string, bool, error)
+	SetEvent(name string, payload []byte) error
+}
+
+type StateIterator interface {
+	HasNext() bool
+	Next() (string, []byte, error)
+	Close() error
+}
+
+type shim_stub struct {
+	shim.ChaincodeStubInterface
+}
+
+func (s shim_stub) GetStateByRange(startKey string, endKey string) (StateIterator, error) {
+	iter, err := s.ChaincodeStubInterface.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return shim_iterator{iter}, nil
+}
+
+func (s shim_stub) GetStateByPartialCompositeKey(objectType string, keys []string) (StateIterator, error) {
+	iter, err := s.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return shim_iterator{iter}, nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination returns the bookmark of the next page instead of the whole metadata.
+// Like the shim call, it is only allowed in read-only transactions.
+func (s shim_stub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (StateIterator, string, error) {
+	iter, metadata, err := s.ChaincodeStubInterface.GetStateByPartialCompositeKeyWithPagination(objectType, keys, pageSize, bookmark)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if metadata != nil {
+		next = metadata.Bookmark
+	}
+	return shim_iterator{iter}, next, nil
+}
+
+// GetTxTime returns the transaction timestamp in unix seconds.
+func (s shim_stub) GetTxTime() (int64, error) {
+	ts, err := s.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds, nil
+}
+
+// GetAttributeValue reads an attribute of the caller's X.509 certificate.
+func (s shim_stub) GetAttributeValue(attrName string) (string, bool, error) {
+	return cid.GetAttributeValue(s.ChaincodeStubInterface, attrName)
+}
+
+type shim_iterator struct {
+	shim.StateQueryIteratorInterface
+}
+
+func (i shim_iterator) Next() (string, []byte, error) {
+	kv, err := i.StateQueryIteratorInterface.Next()
+	if err != nil {
+		return "", nil, err
+	}
+	return kv.Key, kv.Value, nil
+}
+
 //==============================================================================================================================
 //	 Router Functions
 //==============================================================================================================================
-//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		  initial arguments passed to other things for use in the called function e.g. name -> ecert
+//	Invoke - Called on every transaction proposal. Reads the function name and arguments from the proposal and routes
+//			 the query functions to query and everything else to invoke. The function names and arguments are the
+//			 ones clients used with the separate Invoke and Query entry points of earlier Fabric versions.
+//==============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	return response(t.route(shim_stub{stub}, function, args))
+}
+
+// Functions routed to query. They don't write to the ledger, so clients evaluate them instead of submitting them.
+var query_functions = map[string]bool{
+	"get_customer":true, "export_state":true, "get_customer_crossref":true, "get_all_entities":true,
+	"get_customers_by_sender_id":true, "get_customers_by_receiver_id":true, "get_customer_id_by_crossref":true,
+	"get_consent":true, "get_access_log":true, "get_customer_sharing_map":true, "get_customer_by_sender":true,
+	"get_customers_by_sender_and_receiver":true, "get_customers_by_receiver_and_sender":true,
+	"get_customer_history":true, "get_form_template":true, "verify_indexes":true,
+	"get_erasure_certificates":true, "get_records_by_key_id":true, "get_entity":true,
+	"export_entities":true, "get_customer_content":true,
+}
+
+func (t *SimpleChaincode) route(stub StubInterface, function string, args []string) ([]byte, error) {
+	if query_functions[function] {
+		return t.query(stub, function, args)
+	}
+	return t.invoke(stub, function, args)
+}
+
+// response turns the result of a routed function into a peer response. The message of an error response is the
+// JSON encoding of the ChaincodeError.
+func response(payload []byte, err error) pb.Response {
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(payload)
+}
+
+//==============================================================================================================================
+//	event_stub - Records the events of an invoke, for invoke to emit once the function succeeded. The peer keeps one
+//				 chaincode event per transaction, so they go out together as an events.Batch named events.Name.
 //==============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+type event_stub struct {
+	StubInterface
+	events []events.Event
+}
+
+func (s *event_stub) flush() error {
+	if len(s.events) == 0 {
+		return nil
+	}
+	bytes, err := json.Marshal(events.Batch{ Events:s.events })
+	if err != nil { return new_error(ERR_INTERNAL, "Error creating event batch") }
+
+	err = s.SetEvent(events.Name, bytes)
+	if err != nil { return new_error(ERR_STORAGE, "Unable to set the event", err.Error()) }
+	return nil
+}
+
+// emit records event for the transaction. Functions run outside invoke, like the queries, emit nothing.
+func emit(stub StubInterface, event events.Event) {
+	recorder, ok := stub.(*event_stub)
+	if !ok {
+		return
+	}
+	event.TxId = stub.GetTxID()
+	recorder.events = append(recorder.events, event)
+}
+
+// invoke runs an invoke function and emits the events it recorded as the transaction's chaincode event.
+func (t *SimpleChaincode) invoke(stub StubInterface, function string, args []string) ([]byte, error) {
+
+	recorder := &event_stub{ StubInterface:stub }
+
+	payload, err := t.invoke_function(recorder, function, args)
+	if err != nil { return nil, err }
+
+	err = recorder.flush()
+	if err != nil { return nil, err }
 
-	//caller, caller_affiliation, err := t.get_caller_data(stub)
+	return payload, nil
+}
+
+func (t *SimpleChaincode) invoke_function(stub StubInterface, function string, args []string) ([]byte, error) {
 
-	//if err != nil { return nil, errors.New("Error retrieving caller information")}
+	caller, err := t.get_caller_data(stub)
 
+	if err != nil { return nil, new_error(ERR_UNAUTHORIZED, "Error retrieving caller information", err.Error())}
+
+	// while no entity is an admin, the admin named to Init registers itself to become the first one; everything else
+	// is limited to registered entities with a role the function is open to.
+	// migrate_keys has to run before any entity can be found under its new key, so that admin can run it until there
+	// is one.
+	bootstrap := false
+	if function == "register_entity" || function == "migrate_keys" {
+		bootstrap, err = can_bootstrap(stub, caller)
+		if err != nil { return nil, err }
+	}
+	if !bootstrap {
+		err = t.check_permission(stub, caller, function)
+		if err != nil { return nil, err }
+	}
 
 	if function == "register_customer" {
 
-		if len(args) != 4 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) != 5 && len(args) != 7 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		customer_id := args[0]
 		receiver_id := args[1]
 		sender_id := args[2]
 		json_data := args[3]
+		// optionally, the consent form template the data was collected with
+		template_id := ""
+		template_version := ""
+		if len(args) == 7 {
+			template_id = args[4]
+			template_version = args[5]
+		}
+		signature := args[len(args)-1]
 
-		return t.register_customer(stub, customer_id, receiver_id, sender_id, json_data)
+		return t.register_customer(stub, caller, customer_id, receiver_id, sender_id, json_data, template_id, template_version, signature)
 
-	} else if function == "delete_customer" {
+	} else if function == "register_customers_batch" {
 
 		if len(args) != 2 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		batch := args[0]
+		signature := args[1]
+
+		return t.register_customers_batch(stub, caller, batch, signature)
+
+	} else if function == "delete_customer" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		customer_id := args[0]
 		sender_id := args[1]
+		signature := args[2]
+
+		return t.delete_customer(stub, caller, customer_id, sender_id, signature)
 
-		return t.delete_customer(stub, customer_id, sender_id)
+	} else if function == "erase_customer" {
+
+		if len(args) != 2 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		signature := args[1]
+
+		return t.erase_customer(stub, caller, customer_id, signature)
 
 	} else if function == "register_customer_crossref" {
 
 		if len(args) != 3 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		customer_id := args[0]
 		entity_id := args[1]
 		customer_ref := args[2]
 
-		return t.register_customer_crossref(stub, customer_id,  entity_id , customer_ref )
+		return t.register_customer_crossref(stub, caller, customer_id,  entity_id , customer_ref )
 
 	} else if function == "delete_customer_crossref" {
 
-		if len(args) != 2 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		entity_id := args[0]
 		customer_ref := args[1]
+		signature := args[2]
 
-		return t.delete_customer_crossref(stub,  entity_id , customer_ref )
+		return t.delete_customer_crossref(stub, caller, entity_id , customer_ref, signature )
 
 	} else if function == "register_entity" {
 
-		if len(args) != 3 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		entity_id := args[0]
 		entity_name := args[1]
 		entity_public_key := args[2]
+		// optionally, comma separated roles
+		roles := ""
+		if len(args) == 4 {
+			roles = args[3]
+		}
 
-		return t.register_entity(stub,  entity_id , entity_name, entity_public_key )
+		return t.register_entity(stub, caller, bootstrap, entity_id , entity_name, entity_public_key, roles)
 
 	}else if function == "delete_entity" {
 
+		if len(args) != 2 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		entity_id := args[0]
+		signature := args[1]
+
+		return t.delete_entity(stub, caller, entity_id, signature )
+
+	} else if function == "import_entities" {
+
 		if len(args) != 1 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		directory := args[0]
+
+		return t.import_entities(stub, caller, directory)
+
+	} else if function == "rotate_entity_key" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		entity_id := args[0]
+		new_public_key := args[1]
+		signature := args[2]
+
+		return t.rotate_entity_key(stub, caller, entity_id, new_public_key, signature)
+
+	} else if function == "grant_consent" {
+
+		if len(args) != 6 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		sender_id := args[2]
+		purpose := args[3]
+		scope := args[4]
+		expires_at := args[5]
+
+		return t.grant_consent(stub, caller, customer_id, receiver_id, sender_id, purpose, scope, expires_at)
 
-		return t.delete_entity(stub,  entity_id )
+	} else if function == "revoke_consent" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		sender_id := args[2]
+
+		return t.revoke_consent(stub, caller, customer_id, receiver_id, sender_id)
+
+	} else if function == "purge_expired" {
+
+		if len(args) != 0 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		return t.purge_expired(stub)
+
+	} else if function == "access_customer" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		purpose := args[2]
+
+		return t.access_customer(stub, caller, customer_id, receiver_id, purpose)
+
+	} else if function == "register_form_template" {
+
+		if len(args) != 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		template_id := args[0]
+		version := args[1]
+		language := args[2]
+		schema := args[3]
+
+		return t.register_form_template(stub, caller, template_id, version, language, schema)
+
+	} else if function == "migrate_keys" {
+
+		if len(args) > 1 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		page, err := parse_page(args)
+		if err != nil { return nil, err }
+
+		return t.migrate_keys(stub, page.Limit)
+
+	} else if function == "repair_indexes" {
+
+		if len(args) != 0 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		return t.repair_indexes(stub)
 	}
 
-	return nil, errors.New("Function of that name doesn't exist.")
+	return nil, new_error(ERR_VALIDATION, "Function of that name doesn't exist.")
 }
 //=================================================================================================================================
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
+//	query - Called by Invoke for the query functions. Takes a function name passed and calls that function. Passes the
 //  		initial arguments passed are passed on to the called function.
 //=================================================================================================================================
-func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+func (t *SimpleChaincode) query(stub StubInterface, function string, args []string) ([]byte, error) {
+
+	caller, err := t.get_caller_data(stub)
+
+	if err != nil { return nil, new_error(ERR_UNAUTHORIZED, "Error retrieving caller information", err.Error())}
+
+	err = t.check_permission(stub, caller, function)
+	if err != nil { return nil, err }
 
 	if function == "get_customer" {
 
-		if len(args) != 2 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) < 2 || len(args) > 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		customer_id := args[0]
 		receiver_id := args[1]
 
-		return t.get_customer(stub, customer_id, receiver_id)
+		page, err := parse_page(args[2:])
+		if err != nil { return nil, err }
 
-	} else if function == "get_all" {
+		return t.get_customer(stub, caller, customer_id, receiver_id, page)
 
-		if len(args) != 0 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+	} else if function == "export_state" {
+
+		if len(args) > 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
-		return t.get_all(stub)
+		// optionally, an object type and leading IDs, then the page
+		prefix := ""
+		var page Page
+		if len(args) > 0 {
+			prefix = args[0]
+			page, err = parse_page(args[1:])
+			if err != nil { return nil, err }
+		}
+
+		return t.export_state(stub, prefix, page)
 
 	} else if function == "get_customer_crossref"{
 		if len(args) != 2 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		entity_id := args[0]
 		customer_ref := args[1]
 
-		return t.get_customer_crossref(stub, entity_id, customer_ref)
+		return t.get_customer_crossref(stub, caller, entity_id, customer_ref)
 
-	} else if function == "get_all_entities" {
+	} else if function == "get_entity" {
+
+		if len(args) != 1 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		entity_id := args[0]
+
+		return t.get_entity(stub, entity_id)
+
+	} else if function == "export_entities" {
 
 		if len(args) != 0 {
-		fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		return t.export_entities(stub, caller)
+
+	} else if function == "get_all_entities" {
+
+		if len(args) > 2 {
+		fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
-		return t.get_all_entities(stub)
+		page, err := parse_page(args)
+		if err != nil { return nil, err }
+
+		return t.get_all_entities(stub, page)
 
 	}else if function == "get_customers_by_sender_id" {
 
-		if len(args) != 1 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 		sender_id := args[0]
-		return t.get_customers_by_sender_id(stub,sender_id)
+		page, err := parse_page(args[1:])
+		if err != nil { return nil, err }
+
+		return t.get_customers_by_sender_id(stub, caller, sender_id, page)
 
 	}else if function == "get_customers_by_receiver_id" {
 
-		if len(args) != 1 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 		receiver_id := args[0]
-		return t.get_customers_by_receiver_id(stub,receiver_id)
+		page, err := parse_page(args[1:])
+		if err != nil { return nil, err }
+
+		return t.get_customers_by_receiver_id(stub, caller, receiver_id, page)
 
 	}else if function == "get_customer_id_by_crossref"{
 		if len(args) != 2 {
-			fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed")
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
 		}
 
 		entity_id := args[0]
 		customer_ref := args[1]
 
-		return t.get_customer_id_by_crossref(stub, entity_id, customer_ref)
+		return t.get_customer_id_by_crossref(stub, caller, entity_id, customer_ref)
 
+	} else if function == "get_consent" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		sender_id := args[2]
+
+		return t.get_consent(stub, caller, customer_id, receiver_id, sender_id)
+
+	} else if function == "get_access_log" {
+
+		if len(args) < 2 || len(args) > 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		log_type := args[0]
+		id := args[1]
+
+		page, err := parse_page(args[2:])
+		if err != nil { return nil, err }
+
+		return t.get_access_log(stub, caller, log_type, id, page)
+
+	} else if function == "get_customer_sharing_map" {
+
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+
+		page, err := parse_page(args[1:])
+		if err != nil { return nil, err }
+
+		return t.get_customer_sharing_map(stub, caller, customer_id, page)
+
+	} else if function == "get_customer_by_sender" {
+
+		if len(args) < 2 || len(args) > 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		sender_id := args[1]
+
+		page, err := parse_page(args[2:])
+		if err != nil { return nil, err }
+
+		return t.get_customer_by_sender(stub, caller, customer_id, sender_id, page)
+
+	} else if function == "get_customers_by_sender_and_receiver" {
+
+		if len(args) < 2 || len(args) > 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		sender_id := args[0]
+		receiver_id := args[1]
+
+		page, err := parse_page(args[2:])
+		if err != nil { return nil, err }
+
+		return t.get_customers_by_sender_and_receiver(stub, caller, sender_id, receiver_id, page)
+
+	} else if function == "get_customers_by_receiver_and_sender" {
+
+		if len(args) < 2 || len(args) > 4 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		receiver_id := args[0]
+		sender_id := args[1]
+
+		page, err := parse_page(args[2:])
+		if err != nil { return nil, err }
+
+		return t.get_customers_by_receiver_and_sender(stub, caller, receiver_id, sender_id, page)
+
+	} else if function == "get_customer_content" {
+
+		if len(args) != 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		access_tx_id := args[2]
+
+		return t.get_customer_content(stub, caller, customer_id, receiver_id, access_tx_id)
+
+	} else if function == "get_customer_history" {
+
+		if len(args) < 3 || len(args) > 5 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+		receiver_id := args[1]
+		sender_id := args[2]
+
+		page, err := parse_page(args[3:])
+		if err != nil { return nil, err }
+
+		return t.get_customer_history(stub, caller, customer_id, receiver_id, sender_id, page)
+
+	} else if function == "get_erasure_certificates" {
+
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		customer_id := args[0]
+
+		page, err := parse_page(args[1:])
+		if err != nil { return nil, err }
+
+		return t.get_erasure_certificates(stub, customer_id, page)
+
+	} else if function == "get_records_by_key_id" {
+
+		if len(args) < 3 || len(args) > 5 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		receiver_id := args[0]
+		key_id := args[1]
+		// "" lists the data from every sender
+		sender_id := args[2]
+
+		page, err := parse_page(args[3:])
+		if err != nil { return nil, err }
+
+		return t.get_records_by_key_id(stub, caller, receiver_id, key_id, sender_id, page)
+
+	} else if function == "get_form_template" {
+
+		if len(args) != 2 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		template_id := args[0]
+		version := args[1]
+
+		return t.get_form_template(stub, template_id, version)
+
+	} else if function == "verify_indexes" {
+
+		if len(args) != 0 {
+			fmt.Printf("Incorrect number of arguments passed"); return nil, new_error(ERR_VALIDATION, "QUERY: Incorrect number of arguments passed")
+		}
+
+		return t.verify_indexes(stub)
+
+	}
+	return nil, new_error(ERR_VALIDATION, "QUERY: No such function.")
+
+}
+
+//=================================================================================================================================
+//	 Security Functions
+//=================================================================================================================================
+//	 get_caller_data - Retrieves the entity_id of the caller from the "entity_id" attribute of the transaction certificate.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_caller_data(stub StubInterface) (string, error) {
+
+	entity_id, found, err := stub.GetAttributeValue("entity_id")
+	if err != nil { return "", new_error(ERR_UNAUTHORIZED, "Couldn't get attribute 'entity_id'", err.Error()) }
+	if !found || len(entity_id) == 0 { return "", new_error(ERR_UNAUTHORIZED, "Attribute 'entity_id' is empty") }
+
+	return entity_id, nil
+}
+
+//=================================================================================================================================
+//	 check_permission - Checks the caller is a registered entity holding one of the roles the permissions matrix opens
+//						function to.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_permission(stub StubInterface, caller string, function string) error {
+	return check_role(stub, caller, permissions[function]...)
+}
+
+//=================================================================================================================================
+//	 verify_entity_signature - Verifies a base64 encoded detached signature over message against the EntityPublicKey
+//							   registered for entity_id. Unsigned submissions are rejected.
+//=================================================================================================================================
+func (t *SimpleChaincode) verify_entity_signature(stub StubInterface, entity_id string, message []byte, signature string) error {
+
+	if len(signature) == 0 {
+		return new_error(ERR_UNAUTHORIZED, "Missing signature")
+	}
+
+	bytes, err := stub.GetState(entity_key(entity_id))
+	if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return new_error(ERR_NOT_FOUND, "Entity not found", entity_id)
+	}
+
+	var entity Entity
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil { return new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(bytes)) }
+
+	return verify_signature(entity.EntityPublicKey, message, signature)
+}
+
+//=================================================================================================================================
+//	 check_envelope - Checks that json_data is a well formed envelope encrypted to the current EntityPublicKey of receiver_id.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_envelope(stub StubInterface, receiver_id string, json_data string) (*envelope.Envelope, error) {
+
+	env, err := envelope.Parse([]byte(json_data))
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid content envelope", err.Error()) }
+
+	bytes, err := stub.GetState(entity_key(receiver_id))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Receiver is not a registered entity", receiver_id)
+	}
+
+	var receiver Entity
+	err = json.Unmarshal(bytes, &receiver)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(bytes)) }
+
+	err = env.CheckRecipient(receiver.EntityPublicKey)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid content envelope", err.Error()) }
+
+	return env, nil
+}
+
+//=================================================================================================================================
+//	 check_form_fields - Checks the fields declared by a content envelope against the schema of a consent form template.
+//						 The values themselves are encrypted for the receiver, so the ledger can only reject submissions
+//						 that leave out required fields or, when the schema sets additionalProperties to false,
+//						 collect fields the form does not ask for.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_form_fields(stub StubInterface, template_id string, template_version string, fields []string) error {
+
+	bytes, err := stub.GetState(form_template_key(template_id, template_version))
+	if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return new_error(ERR_NOT_FOUND, "Form template not found", template_id + " " + template_version)
+	}
+
+	var template FormTemplate
+	err = json.Unmarshal(bytes, &template)
+	if err != nil { return new_error(ERR_INTERNAL, "Corrupt FormTemplate record", err.Error(), string(bytes)) }
+
+	schema, err := parse_form_schema(template.Schema)
+	if err != nil { return err }
+
+	declared := map[string]bool{}
+	for _, field := range fields {
+		if declared[field] {
+			return new_error(ERR_VALIDATION, "Duplicate field in content envelope", field)
+		}
+		declared[field] = true
+
+		_, known := schema.Properties[field]
+		if !known && schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+			return new_error(ERR_VALIDATION, "Field not in form template", template_id + ": " + field)
+		}
+	}
+	for _, field := range schema.Required {
+		if !declared[field] {
+			return new_error(ERR_VALIDATION, "Missing required field for form template", template_id + ": " + field)
+		}
 	}
-	return nil, errors.New("QUERY: No such function.")
 
+	return nil
 }
 
 //=================================================================================================================================
 //	 Register Function
 //======================================================================================================
 
-func (t *SimpleChaincode) register_customer(stub *shim.ChaincodeStub, customer_id string, receiver_id string, sender_id string, json_data string) ([]byte, error) {
+func (t *SimpleChaincode) register_customer(stub StubInterface, caller string, customer_id string, receiver_id string, sender_id string, json_data string, template_id string, template_version string, signature string) ([]byte, error) {
+
+
+	err := check_ids(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id)
+	if err != nil { return nil, err }
+
+	signed := []string{customer_id, receiver_id, sender_id, json_data}
+	if len(template_id) > 0 {
+		signed = append(signed, template_id, template_version)
+	}
+	err = t.verify_entity_signature(stub, sender_id, canonical_args("register_customer", signed...), signature)
+	if err != nil { return nil, err }
+
+	env, err := t.check_customer_data(stub, customer_id, receiver_id, sender_id, json_data, template_id, template_version)
+	if err != nil { return nil, err }
+
+	_, err = write_customer_data(stub, customer_id, receiver_id, sender_id, json_data, template_id, template_version, env)
+	if err != nil { return nil, err }
+
+	return nil, nil
+
+}
+
+// check_customer_data checks the sender may share json_data with the receiver for the customer, and returns its envelope.
+func (t *SimpleChaincode) check_customer_data(stub StubInterface, customer_id string, receiver_id string, sender_id string, json_data string, template_id string, template_version string) (*envelope.Envelope, error) {
 
+	// data can only be shared while the customer's consent for this sender -> receiver pair is active
+	active, err := t.consent_active(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+	if !active {
+		return nil, new_error(ERR_UNAUTHORIZED, "No active consent for this customer, receiver and sender")
+	}
+
+	// json_data must be encrypted for the receiver's current key; see the envelope package for the format
+	env, err := t.check_envelope(stub, receiver_id, json_data)
+	if err != nil { return nil, err }
 
-	if(!valid_key(customer_id)||!valid_key(receiver_id)||!valid_key(sender_id)){
-		return nil, errors.New("Invalid arguments")
+	if len(template_id) > 0 {
+		err = check_ids(stub, template_id, template_version)
+		if err != nil { return nil, err }
+		err = t.check_form_fields(stub, template_id, template_version, env.Fields)
+		if err != nil { return nil, err }
 	}
 
+	return env, nil
+}
+
+// write_customer_data stores json_data as the next version of the data shared from sender_id to receiver_id, with
+// its history entry and index keys, and returns the version number.
+func write_customer_data(stub StubInterface, customer_id string, receiver_id string, sender_id string, json_data string, template_id string, template_version string, env *envelope.Envelope) (int, error) {
+
 	var data_key, scr_key, src_key, rsc_key, csr_key, crs_key string;
 	data_key, scr_key, src_key, rsc_key, csr_key, crs_key = create_keys(customer_id, receiver_id, sender_id)
-	var err error
+
+	// each write creates a new version, numbered on from the one currently stored
+	current, err := stub.GetState(data_key)
+	if err != nil { return 0, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+
+	now, err := get_tx_time(stub)
+	if err != nil { return 0, err }
+
+	hash := sha256.Sum256([]byte(json_data))
+	content, opaque := encode_content(json_data)
+	version := DataVersion{ Version:1, TxId:stub.GetTxID(), Timestamp:now, ContentHash:hex.EncodeToString(hash[:]), TemplateId:template_id, TemplateVersion:template_version, KeyId:env.Kid, Opaque:opaque, Content:content }
+	if len(current) > 0 {
+		previous := read_data_version(current)
+		version.Version = previous.Version + 1
+
+		// a re-submission encrypted to a rotated key moves the record from the old key's index to the new one
+		previous_key_id := version_key_id(previous)
+		if len(previous_key_id) > 0 && previous_key_id != version.KeyId {
+			err = stub.DelState(key_id_key(receiver_id, previous_key_id, sender_id, customer_id))
+			if err != nil {
+				return 0, new_error(ERR_STORAGE, "Unable to delete the state")
+			}
+		}
+	}
+
+	bytes, err := json.Marshal(version)
+	if err != nil { return 0, new_error(ERR_INTERNAL, "Error creating DataVersion record") }
+
 	// register the value to KVS
-	fmt.Println("[DEBUG] PutState " + data_key + " , " + json_data)
-	err = stub.PutState(data_key, []byte(json_data))
+	err = stub.PutState(history_key(customer_id, receiver_id, sender_id, version.Version), bytes)
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+	err = stub.PutState(data_key, bytes)
+	if err != nil {
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 
 	// then, create index data
 	err = stub.PutState(scr_key, []byte(data_key))
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 	err = stub.PutState(src_key, []byte(data_key))
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 	err = stub.PutState(rsc_key, []byte(data_key))
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 	err = stub.PutState(csr_key, []byte(data_key))
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 	err = stub.PutState(crs_key, []byte(data_key))
 	if err != nil {
-		return nil, errors.New("Unable to put the state")
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+	err = stub.PutState(key_id_key(receiver_id, version.KeyId, sender_id, customer_id), []byte(data_key))
+	if err != nil {
+		return 0, new_error(ERR_STORAGE, "Unable to put the state")
 	}
 
-	return nil, nil
+	emit(stub, events.Event{ Type:events.DataRegistered, CustomerId:customer_id, SenderId:sender_id, ReceiverId:receiver_id, Version:version.Version })
+
+	return version.Version, nil
 
 }
 
-func (t *SimpleChaincode) delete_customer(stub *shim.ChaincodeStub, customer_id string, sender_id string) ([]byte, error) {
+// register_customers_batch registers the data of many customers from the caller in one transaction. batch is a JSON
+// array of CustomerBatchEntry, all sent by the caller, and signature is the caller's signature over the canonical
+// arguments. Every entry is checked as register_customer would before anything is written: if any is rejected, nothing
+// is, and the error carries the result of every entry in its details.
+func (t *SimpleChaincode) register_customers_batch(stub StubInterface, caller string, batch string, signature string) ([]byte, error) {
+
+	err := t.verify_entity_signature(stub, caller, canonical_args("register_customers_batch", batch), signature)
+	if err != nil { return nil, err }
+
+	var entries []CustomerBatchEntry
+	err = json.Unmarshal([]byte(batch), &entries)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid batch", err.Error()) }
+	if len(entries) == 0 || len(entries) > MAX_BATCH_SIZE {
+		return nil, new_error(ERR_VALIDATION, "Invalid batch", fmt.Sprintf("a batch holds 1 to %d entries", MAX_BATCH_SIZE))
+	}
+
+	results := CustomerBatchResult_Holder{ Results:make([]CustomerBatchResult, len(entries)) }
+	envelopes := make([]*envelope.Envelope, len(entries))
+	seen := map[string]bool{}
+	var rejected *ChaincodeError
+
+	for i, entry := range entries {
+		results.Results[i] = CustomerBatchResult{ CustomerId:entry.CustomerId, ReceiverId:entry.ReceiverId, SenderId:entry.SenderId }
+
+		err := check_ids(stub, entry.CustomerId, entry.ReceiverId, entry.SenderId)
+		if err == nil {
+			err = check_caller(caller, entry.SenderId)
+		}
+		// reads in a transaction don't see its own writes, so a flow written twice would get the same version twice
+		data_key := get_key("data_key", entry.CustomerId, entry.ReceiverId, entry.SenderId)
+		if err == nil && seen[data_key] {
+			err = new_error(ERR_VALIDATION, "Duplicate entry in the batch")
+		}
+		seen[data_key] = true
+		if err == nil {
+			envelopes[i], err = t.check_customer_data(stub, entry.CustomerId, entry.ReceiverId, entry.SenderId, string(entry.Content), entry.TemplateId, entry.TemplateVersion)
+		}
+		if err != nil {
+			cc_err, ok := err.(*ChaincodeError)
+			if !ok {
+				cc_err = &ChaincodeError{ Code:ERR_INTERNAL, Message:err.Error() }
+			}
+			results.Results[i].Error = cc_err
+			if rejected == nil {
+				rejected = cc_err
+			}
+		}
+	}
 
+	if rejected != nil {
+		bytes, err := json.Marshal(results)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating CustomerBatchResult record") }
+		return nil, new_error(rejected.Code, "Batch rejected, nothing was written", string(bytes))
+	}
 
-	if(!valid_key(customer_id)||!valid_key(sender_id)){
-		return nil, errors.New("Invalid arguments")
+	for i, entry := range entries {
+		results.Results[i].Version, err = write_customer_data(stub, entry.CustomerId, entry.ReceiverId, entry.SenderId, string(entry.Content), entry.TemplateId, entry.TemplateVersion, envelopes[i])
+		if err != nil { return nil, err }
 	}
 
-	keysIter, err := stub.RangeQueryState("SCR/" + sender_id + "/" + customer_id + "/", "SCR/" + sender_id + "/" + customer_id + "/" + "|")
+	bytes, err := json.Marshal(results)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating CustomerBatchResult record") }
+
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) delete_customer(stub StubInterface, caller string, customer_id string, sender_id string, signature string) ([]byte, error) {
+
+
+	err := check_ids(stub, customer_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id)
+	if err != nil { return nil, err }
+
+	err = t.verify_entity_signature(stub, sender_id, canonical_args("delete_customer", customer_id, sender_id), signature)
+	if err != nil { return nil, err }
+
+	keysIter, err := stub.GetStateByPartialCompositeKey("SCR", []string{sender_id, customer_id})
 	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
+		return nil, new_error(ERR_STORAGE, "Unable to start the iterator")
 	}
 
 	defer keysIter.Close()
@@ -276,344 +1436,2072 @@ func (t *SimpleChaincode) delete_customer(stub *shim.ChaincodeStub, customer_id
 	for keysIter.HasNext() {
 		key, _, iterErr := keysIter.Next()
 		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
+			return nil, new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
 		}
 		customer_id, receiver_id, sender_id := parse_key(key)
-		data_key, scr_key, src_key, rsc_key, csr_key, crs_key := create_keys(customer_id, receiver_id, sender_id)
 
-		// remove the value in KVS
-		err = stub.DelState(data_key)
+		err = delete_customer_data(stub, customer_id, receiver_id, sender_id)
 		if err != nil {
-			return nil, errors.New("Unable to delete the state")
+			return nil, err
 		}
+	}
+	return nil, nil
 
-		// then, remove index data
-		err = stub.DelState(scr_key)
-		if err != nil {
-			return nil, errors.New("Unable to delete the state")
-		}
-		err = stub.DelState(src_key)
-		if err != nil {
-			return nil, errors.New("Unable to delete the state")
-		}
-		err = stub.DelState(rsc_key)
-		if err != nil {
-			return nil, errors.New("Unable to delete the state")
+}
+
+// erase_customer removes everything held about the customer: the data shared between every sender and receiver, found
+// through the CSR and CRS indexes, with its indexes and history, and the customer's crossrefs. Consents still in force
+// are revoked so that no data can be shared again without a new one. The Consent records and access log stay as
+// evidence, and an ErasureCertificate is left to prove the erasure happened; it is also the result.
+// Only a consent manager, acting on the customer's request, or a regulator can erase a customer: a consent or crossref
+// proves nothing about the customer's wishes, as the entity holding it may have created it itself.
+func (t *SimpleChaincode) erase_customer(stub StubInterface, caller string, customer_id string, signature string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id)
+	if err != nil { return nil, err }
+
+	err = t.verify_entity_signature(stub, caller, canonical_args("erase_customer", customer_id), signature)
+	if err != nil { return nil, err }
+
+	var cust_refs CustRef_Holder
+	bytes, err := stub.GetState(custid_key(customer_id))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) > 0 {
+		err = json.Unmarshal(bytes, &cust_refs)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record", err.Error(), string(bytes)) }
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	certificate := ErasureCertificate{ CustomerId:customer_id, RequestedBy:caller, ErasedAt:now, TxId:stub.GetTxID() }
+
+	// the data is found through both of the customer's indexes, so that data one of them lost is erased all the same
+	var flows [][2]string
+	found := map[[2]string]bool{}
+	for _, index := range []string{"CSR", "CRS"} {
+		_, err = range_page(stub, make_key(index, customer_id), Page{}, func(key string, val []byte) error {
+			_, receiver_id, sender_id := parse_key(key)
+			flow := [2]string{receiver_id, sender_id}
+			if !found[flow] {
+				found[flow] = true
+				flows = append(flows, flow)
+			}
+			return nil
+		})
+		if err != nil { return nil, err }
+	}
+	for _, flow := range flows {
+		data, err := stub.GetState(get_key("data_key", customer_id, flow[0], flow[1]))
+		if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		if len(data) > 0 {
+			certificate.Records++
 		}
-		err = stub.DelState(csr_key)
-		if err != nil {
-			return nil, errors.New("Unable to delete the state")
+		err = delete_customer_data(stub, customer_id, flow[0], flow[1])
+		if err != nil { return nil, err }
+	}
+
+	_, err = range_page(stub, make_key("CONSENT", customer_id), Page{}, func(key string, val []byte) error {
+		var consent Consent
+		err := json.Unmarshal(val, &consent)
+		if err != nil { return new_error(ERR_INTERNAL, "Corrupt Consent record", strconv.Quote(key)) }
+		if consent.RevokedAt != 0 {
+			return nil
 		}
-		err = stub.DelState(crs_key)
-		if err != nil {
-			return nil, errors.New("Unable to delete the state")
+
+		consent.RevokedAt = now
+		bytes, err := json.Marshal(consent)
+		if err != nil { return new_error(ERR_INTERNAL, "Error creating Consent record") }
+
+		err = stub.PutState(key, bytes)
+		if err != nil { return new_error(ERR_STORAGE, "Unable to put the state") }
+		certificate.ConsentsRevoked++
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	// a pointer is only removed if it points to this customer, see repair_indexes for the others
+	for _, ref := range cust_refs.CustRefs {
+		ref_key := custref_key(ref.EntityId, ref.CustomerRef)
+		pointer, err := stub.GetState(ref_key)
+		if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		if string(pointer) != custid_key(customer_id) {
+			continue
 		}
+		err = stub.DelState(ref_key)
+		if err != nil { return nil, new_error(ERR_STORAGE, "Unable to delete the state") }
+		certificate.Crossrefs++
+		emit(stub, events.Event{ Type:events.CrossrefDeleted, CustomerId:customer_id, EntityId:ref.EntityId })
 	}
-	return nil, nil
+	err = stub.DelState(custid_key(customer_id))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to delete the state") }
+
+	bytes, err = json.Marshal(certificate)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating ErasureCertificate record") }
+
+	err = stub.PutState(make_key("ERASURE", customer_id, certificate.TxId), bytes)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to put the state") }
+
+	return bytes, nil
 
 }
 
-func (t *SimpleChaincode) register_customer_crossref(stub *shim.ChaincodeStub,customer_id string, entity_id string, customer_ref string) ([]byte, error) {
+func (t *SimpleChaincode) register_customer_crossref(stub StubInterface, caller string, customer_id string, entity_id string, customer_ref string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, entity_id, customer_ref)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, entity_id)
+	if err != nil { return nil, err }
 
-	if(!valid_key(customer_id)||!valid_key(entity_id)||!valid_key(customer_ref)){
-		return nil, errors.New("Invalid arguments")
-	}
 	// check first to see if the crossref is already registered
-	ckey:="CUSTREF/"+entity_id+"/"+customer_ref
+	ckey:=custref_key(entity_id, customer_ref)
 	cval, err := stub.GetState(ckey)
-	if err != nil { return nil, errors.New("Error in GetState: " + err.Error())	}
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())	}
 	if len(cval) > 0 { //found
-		return nil, errors.New("Duplicate CustRef record")
+		return nil, new_error(ERR_DUPLICATE, "Duplicate CustRef record")
 	}
 
 	var cust_refs CustRef_Holder
 
-	key := "CUSTID/"+customer_id
+	key := custid_key(customer_id)
 	bytes, err := stub.GetState(key)
-	if err != nil { return nil, errors.New("Error in GetState: " + err.Error())	}
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())	}
 
 	if len(bytes) > 0 {
 		err = json.Unmarshal(bytes, &cust_refs)
 		if err != nil {
-			return nil, errors.New("Corrupt CustRef record: " + err.Error() + string(bytes))
+			return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record", err.Error(), string(bytes))
 		}
 		//find duplicate
 		for _, ref := range cust_refs.CustRefs {
 			if (ref.CustomerRef == customer_ref && ref.EntityId == entity_id) {
-				return nil, errors.New("Duplicate CustRef record")
+				return nil, new_error(ERR_DUPLICATE, "Duplicate CustRef record")
 			}
 		}
 	}
 
-	cust_refs.CustRefs = append(cust_refs.CustRefs, CustRef{EntityId:entity_id, CustomerRef:customer_ref})
-
-	bytes, err = json.Marshal(cust_refs)
-	if err != nil { return nil, errors.New("Error creating CustRef record") }
+	cust_refs.CustRefs = append(cust_refs.CustRefs, CustRef{EntityId:entity_id, CustomerRef:customer_ref})
+
+	bytes, err = json.Marshal(cust_refs)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating CustRef record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to put the state") }
+
+	// register ref key
+	ref_key := custref_key(entity_id, customer_ref)
+
+	err = stub.PutState(ref_key, []byte(key))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to put the state") }
+
+	emit(stub, events.Event{ Type:events.CrossrefRegistered, CustomerId:customer_id, EntityId:entity_id })
+	return nil, nil
+
+}
+
+func (t *SimpleChaincode) delete_customer_crossref(stub StubInterface, caller string, entity_id string, customer_ref string, signature string) ([]byte, error) {
+
+
+	err := check_ids(stub, entity_id, customer_ref)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, entity_id)
+	if err != nil { return nil, err }
+
+	err = t.verify_entity_signature(stub, entity_id, canonical_args("delete_customer_crossref", entity_id, customer_ref), signature)
+	if err != nil { return nil, err }
+
+	ckey:=custref_key(entity_id, customer_ref)
+	datakeyAsbytes, err := stub.GetState(ckey)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Failed to get state", ckey)
+	}
+	if len(datakeyAsbytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "CustRef not found", ckey)
+	}
+
+	key:=string(datakeyAsbytes)
+
+	//key := custid_key(customer_id)
+	bytes, err := stub.GetState(key)
+	if err != nil || len(bytes) == 0 {
+		return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record / customer record not found", key)
+	}
+
+	var cust_refs CustRef_Holder
+	err = json.Unmarshal(bytes, &cust_refs)
+	if err != nil {	return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record", string(bytes)) }
+
+	//find entry
+	for i := len(cust_refs.CustRefs) - 1; i >= 0; i-- {
+		ref:=cust_refs.CustRefs[i]
+		if (ref.CustomerRef == customer_ref && ref.EntityId == entity_id) {
+			// found, take this element from cust_ref
+			cust_refs.CustRefs = append(cust_refs.CustRefs[:i],cust_refs.CustRefs[i+1:]...)
+			break
+		}
+	}
+
+	if len(cust_refs.CustRefs) == 0 {
+		err = stub.DelState(key)
+		if err != nil { return nil, new_error(ERR_STORAGE, "Unable to delete the state") }
+	} else {
+		bytes, err = json.Marshal(cust_refs)
+		if err != nil {
+			return nil, new_error(ERR_INTERNAL, "Error creating CustRef record")
+		}
+
+		err = stub.PutState(key, bytes)
+		if err != nil {
+			return nil, new_error(ERR_STORAGE, "Unable to put the state")
+		}
+	}
+	// delete ref key
+	ref_key := custref_key(entity_id, customer_ref)
+
+	err = stub.DelState(ref_key)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to delete the state") }
+
+	_, ids := split_key(key)
+	if len(ids) == 1 {
+		emit(stub, events.Event{ Type:events.CrossrefDeleted, CustomerId:ids[0], EntityId:entity_id })
+	}
+	return nil, nil
+
+}
+
+// register_entity registers or updates an entity on behalf of an admin. roles is comma separated; when empty, a new
+// entity gets DEFAULT_ROLES and an existing one keeps its roles. While no entity is an admin, on a new ledger or one
+// upgraded from before roles, the admin named to Init registers itself (bootstrap) and always becomes an admin, so
+// that it can register the others.
+func (t *SimpleChaincode) register_entity(stub StubInterface, caller string, bootstrap bool, entity_id string, entity_name string, entity_public_key string, roles string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id)
+	if err != nil { return nil, err }
+	if len(entity_public_key) == 0 {
+		return nil, new_error(ERR_VALIDATION, "Invalid arguments", "entity_public_key is empty")
+	}
+
+	var entity_roles []string
+	if len(roles) > 0 {
+		entity_roles, err = parse_roles(roles)
+		if err != nil { return nil, err }
+	}
+
+	if bootstrap {
+		err = check_caller(caller, entity_id)
+		if err != nil { return nil, err }
+		if len(entity_roles) == 0 {
+			entity_roles = DEFAULT_ROLES
+		}
+		entity_roles = sorted_roles(append([]string{ ROLE_ADMIN }, entity_roles...))
+	}
+
+	// the key is used to verify the entity's signed submissions, so it has to be one we can verify with
+	_, err = parse_public_key(entity_public_key)
+	if err != nil { return nil, err }
+
+	ekey:= entity_key(entity_id)
+	entity_data:= Entity{ EntityId:entity_id , EntityName:entity_name , EntityPublicKey:entity_public_key, Roles:entity_roles }
+
+	// check if the record already exists.
+	// If exists, further check if customer data that was sent to the entity exists.
+	// You can"t delete or modify the public key if such customer data exists.
+	eval, err := stub.GetState(ekey)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())	}
+	if len(eval) > 0 { //found
+		var entity_existed Entity
+		err = json.Unmarshal(eval, &entity_existed)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(eval))}
+		has_data, err := has_received_data(stub, entity_existed.EntityId)
+		if err != nil { return nil, err }
+		if has_data && entity_existed.EntityPublicKey != entity_public_key{
+			return nil, new_error(ERR_CONFLICT, "You can't modify existing entity record if customer data exists", "use rotate_entity_key")
+		}
+		entity_data.PreviousKeys = entity_existed.PreviousKeys
+		if entity_existed.EntityPublicKey == entity_public_key {
+			entity_data.KeyValidFrom = entity_existed.KeyValidFrom
+		}
+		if len(entity_data.Roles) == 0 {
+			entity_data.Roles = entity_existed.Roles
+		}
+	}
+	if len(entity_data.Roles) == 0 {
+		entity_data.Roles = DEFAULT_ROLES
+	}
+
+	// an admin can't give up its own admin role, so that the ledger is never left without one
+	if entity_id == caller && !has_role(entity_data.Roles, ROLE_ADMIN) && check_role(stub, caller, ROLE_ADMIN) == nil {
+		return nil, new_error(ERR_CONFLICT, "An admin can't remove its own admin role")
+	}
+
+	entity_data.KeyId, err = envelope.KeyID(entity_public_key)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid public key", err.Error()) }
+	if entity_data.KeyValidFrom == 0 {
+		entity_data.KeyValidFrom, err = get_tx_time(stub)
+		if err != nil { return nil, err }
+	}
+
+	bytes, err := json.Marshal(entity_data)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Entity record") }
+
+	err = stub.PutState(ekey, []byte(bytes))
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
+	emit(stub, events.Event{ Type:events.EntityRegistered, EntityId:entity_id })
+	return nil, nil
+
+}
+
+// rotate_entity_key replaces the entity's public key with new_public_key. signature is made with the new key over
+// the canonical arguments, to show that the entity holds it. The replaced key is kept in PreviousKeys: data
+// encrypted to it stays readable to the entity until its senders re-submit it encrypted to the new key, which
+// get_records_by_key_id tells them to do.
+func (t *SimpleChaincode) rotate_entity_key(stub StubInterface, caller string, entity_id string, new_public_key string, signature string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, entity_id)
+	if err != nil { return nil, err }
+
+	_, err = parse_public_key(new_public_key)
+	if err != nil { return nil, err }
+
+	err = verify_signature(new_public_key, canonical_args("rotate_entity_key", entity_id, new_public_key), signature)
+	if err != nil { return nil, err }
+
+	new_key_id, err := envelope.KeyID(new_public_key)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid public key", err.Error()) }
+
+	ekey := entity_key(entity_id)
+	bytes, err := stub.GetState(ekey)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Entity not found", entity_id)
+	}
+
+	var entity Entity
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(bytes)) }
+
+	// entities registered before key IDs were recorded have neither the ID nor the start of their current key
+	if len(entity.KeyId) == 0 {
+		entity.KeyId, err = envelope.KeyID(entity.EntityPublicKey)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(bytes)) }
+	}
+
+	// a retired key stays retired, so that the key ID of stored data always names one key
+	if new_key_id == entity.KeyId {
+		return nil, new_error(ERR_CONFLICT, "The key is already the entity's current key", new_key_id)
+	}
+	for _, previous := range entity.PreviousKeys {
+		if new_key_id == previous.KeyId {
+			return nil, new_error(ERR_CONFLICT, "The key was used by the entity before", new_key_id)
+		}
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	entity.PreviousKeys = append(entity.PreviousKeys, EntityKey{ KeyId:entity.KeyId, PublicKey:entity.EntityPublicKey, ValidFrom:entity.KeyValidFrom, ValidUntil:now })
+	entity.EntityPublicKey = new_public_key
+	entity.KeyId = new_key_id
+	entity.KeyValidFrom = now
+
+	bytes, err = json.Marshal(entity)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Entity record") }
+
+	err = stub.PutState(ekey, bytes)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Unable to put the state") }
+
+	emit(stub, events.Event{ Type:events.EntityKeyRotated, EntityId:entity_id })
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) delete_entity(stub StubInterface, caller string, entity_id string, signature string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id)
+	if err != nil { return nil, err }
+
+	// signed by the admin deleting the entity
+	err = t.verify_entity_signature(stub, caller, canonical_args("delete_entity", entity_id), signature)
+	if err != nil { return nil, err }
+
+	if entity_id == caller {
+		return nil, new_error(ERR_CONFLICT, "An admin can't delete its own entity record")
+	}
+
+	ekey:= entity_key(entity_id)
+
+	// check if the record exists.
+	// If exists, further check if customer data that was sent to the entity exists.
+	// You can"t delete or modify the public key if such customer data exists.
+	eval, err := stub.GetState(ekey)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())	}
+	if len(eval) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Entity not found", entity_id)
+	}
+	var entity_existed Entity
+	err = json.Unmarshal(eval, &entity_existed)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(eval))}
+	has_data, err := has_received_data(stub, entity_existed.EntityId)
+	if err != nil { return nil, err }
+	if has_data {
+		return nil, new_error(ERR_CONFLICT, "You can't delete existing entity record if customer data exists")
+	}
+
+	err = stub.DelState(ekey)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to delete the state")
+	}
+
+	emit(stub, events.Event{ Type:events.EntityDeleted, EntityId:entity_id })
+	return nil, nil
+
+}
+
+// import_entities registers every entity of an EntityDirectory made by export_entities, keeping their roles and key
+// history. Entities already registered with the same record are left as they are, so a directory can be imported
+// again. As in register_entity, the key of an entity that has received data can't be replaced, and the key history
+// of an entity already registered is kept, see merge_key_history; nothing is written unless every entity can be.
+func (t *SimpleChaincode) import_entities(stub StubInterface, caller string, directory string) ([]byte, error) {
+
+	var snapshot EntityDirectory
+	err := json.Unmarshal([]byte(directory), &snapshot)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid entity directory", err.Error()) }
+	if snapshot.Count != len(snapshot.Entities) {
+		return nil, new_error(ERR_VALIDATION, "Invalid entity directory", fmt.Sprintf("%d of %d entities", len(snapshot.Entities), snapshot.Count))
+	}
+
+	report := EntityImportReport{ Created:[]string{}, Updated:[]string{}, Unchanged:[]string{} }
+	records := map[string][]byte{}
+	var changed []string
+
+	for _, entity := range snapshot.Entities {
+		err = check_ids(stub, entity.EntityId)
+		if err != nil { return nil, err }
+		if records[entity.EntityId] != nil {
+			return nil, new_error(ERR_VALIDATION, "Duplicate entity in the directory", entity.EntityId)
+		}
+
+		_, err = parse_public_key(entity.EntityPublicKey)
+		if err != nil { return nil, err }
+		key_id, err := envelope.KeyID(entity.EntityPublicKey)
+		if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid public key", err.Error()) }
+		if len(entity.KeyId) > 0 && entity.KeyId != key_id {
+			return nil, new_error(ERR_VALIDATION, "Key ID does not match the public key", entity.EntityId)
+		}
+		entity.KeyId = key_id
+
+		if len(entity.Roles) > 0 {
+			entity.Roles, err = parse_roles(strings.Join(entity.Roles, ","))
+			if err != nil { return nil, err }
+		}
+		if entity.EntityId == caller && !has_role(entity_roles(entity), ROLE_ADMIN) {
+			return nil, new_error(ERR_CONFLICT, "An admin can't remove its own admin role")
+		}
+		for _, previous := range entity.PreviousKeys {
+			if previous.KeyId == entity.KeyId {
+				return nil, new_error(ERR_VALIDATION, "The current key is also a previous key", entity.EntityId)
+			}
+		}
+
+		existing, err := stub.GetState(entity_key(entity.EntityId))
+		if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		var entity_existed Entity
+		if len(existing) > 0 {
+			err = json.Unmarshal(existing, &entity_existed)
+			if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(existing)) }
+			err = merge_key_history(&entity, entity_existed)
+			if err != nil { return nil, err }
+		}
+
+		bytes, err := json.Marshal(entity)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Entity record") }
+		records[entity.EntityId] = bytes
+
+		if len(existing) == 0 {
+			report.Created = append(report.Created, entity.EntityId)
+			changed = append(changed, entity.EntityId)
+			continue
+		}
+		if string(existing) == string(bytes) {
+			report.Unchanged = append(report.Unchanged, entity.EntityId)
+			continue
+		}
+
+		if entity_existed.EntityPublicKey != entity.EntityPublicKey {
+			has_data, err := has_received_data(stub, entity.EntityId)
+			if err != nil { return nil, err }
+			if has_data {
+				return nil, new_error(ERR_CONFLICT, "You can't modify existing entity record if customer data exists", entity.EntityId)
+			}
+		}
+		report.Updated = append(report.Updated, entity.EntityId)
+		changed = append(changed, entity.EntityId)
+	}
+
+	for _, entity_id := range changed {
+		err = stub.PutState(entity_key(entity_id), records[entity_id])
+		if err != nil { return nil, new_error(ERR_STORAGE, "Unable to put the state") }
+		emit(stub, events.Event{ Type:events.EntityRegistered, EntityId:entity_id })
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating EntityImportReport record") }
+
+	return bytes, nil
+}
+
+// grant_consent records the customer's consent to share their data from sender_id to receiver_id. Only consent managers,
+// which act on behalf of the customer for any flow, can grant one: a sender granting itself consent would prove nothing.
+func (t *SimpleChaincode) grant_consent(stub StubInterface, caller string, customer_id string, receiver_id string, sender_id string, purpose string, scope string, expires_at string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	// expires_at is unix seconds. Empty or 0 means the consent does not expire.
+	var expires int64
+	if len(expires_at) > 0 {
+		var err error
+		expires, err = strconv.ParseInt(expires_at, 10, 64)
+		if err != nil || expires < 0 { return nil, new_error(ERR_VALIDATION, "Invalid expires_at", expires_at) }
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+	if expires != 0 && expires <= now {
+		return nil, new_error(ERR_VALIDATION, "expires_at must be in the future")
+	}
+
+	consent := Consent{ CustomerId:customer_id, SenderId:sender_id, ReceiverId:receiver_id, Purpose:purpose, Scope:scope, GrantedAt:now, ExpiresAt:expires }
+
+	bytes, err := json.Marshal(consent)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Consent record") }
+
+	err = stub.PutState(consent_key(customer_id, receiver_id, sender_id), bytes)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
+	return nil, nil
+
+}
+
+func (t *SimpleChaincode) revoke_consent(stub StubInterface, caller string, customer_id string, receiver_id string, sender_id string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id, receiver_id)
+	if err != nil {
+		err = check_role(stub, caller, ROLE_CONSENT_MANAGER)
+	}
+	if err != nil { return nil, err }
+
+	consent, err := get_consent_record(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+	if consent == nil {
+		return nil, new_error(ERR_NOT_FOUND, "Consent not found")
+	}
+	if consent.RevokedAt != 0 {
+		return nil, new_error(ERR_CONFLICT, "Consent already revoked")
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+	consent.RevokedAt = now
+
+	bytes, err := json.Marshal(consent)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating Consent record") }
+
+	err = stub.PutState(consent_key(customer_id, receiver_id, sender_id), bytes)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
+	// the withdrawal is enforced here: the shared data and its indexes are removed in the same transaction
+	err = delete_customer_data(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	return nil, nil
+
+}
+
+// purge_expired deletes the data and index keys of every consent that has lapsed at the time of this transaction.
+// The Consent records themselves are kept as evidence of what was agreed.
+func (t *SimpleChaincode) purge_expired(stub StubInterface) ([]byte, error) {
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	keysIter, err := stub.GetStateByPartialCompositeKey("CONSENT", []string{})
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to start the iterator")
+	}
+
+	defer keysIter.Close()
+
+	for keysIter.HasNext() {
+		key, val, iterErr := keysIter.Next()
+		if iterErr != nil {
+			return nil, new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
+		}
+
+		var consent Consent
+		err = json.Unmarshal(val, &consent)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Consent record", key) }
+
+		if consent.RevokedAt != 0 || consent.ExpiresAt == 0 || now < consent.ExpiresAt {
+			continue
+		}
+
+		// data can't be shared again under a lapsed consent, so once its data is gone there is nothing left to purge
+		data, err := stub.GetState(get_key("data_key", consent.CustomerId, consent.ReceiverId, consent.SenderId))
+		if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		if len(data) == 0 {
+			continue
+		}
+
+		err = delete_customer_data(stub, consent.CustomerId, consent.ReceiverId, consent.SenderId)
+		if err != nil { return nil, err }
+	}
+
+	return nil, nil
+
+}
+
+// access_customer records who is about to read the customer's data, when and why, and returns the AccessRecord.
+// It returns no data: a client could evaluate it rather than submit it, and so read the data without the record ever
+// being committed. Once the transaction is committed, get_customer_content returns the data under its tx_id.
+func (t *SimpleChaincode) access_customer(stub StubInterface, caller string, customer_id string, receiver_id string, purpose string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id)
+	if err != nil { return nil, err }
+	if len(purpose) == 0 {
+		return nil, new_error(ERR_VALIDATION, "Invalid arguments", "purpose is empty")
+	}
+
+	err = check_caller(caller, receiver_id)
+	if err != nil { return nil, err }
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	access := AccessRecord{ AccessorId:caller, CustomerId:customer_id, ReceiverId:receiver_id, Purpose:purpose, AccessedAt:now, TxId:stub.GetTxID() }
+
+	bytes, err := json.Marshal(access)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating AccessRecord record") }
+
+	customer_key, entity_key := access_keys(access)
+
+	err = stub.PutState(customer_key, bytes)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+	err = stub.PutState(entity_key, []byte(customer_key))
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
+	return bytes, nil
+
+}
+
+// register_form_template registers version of a consent form template. schema is a JSON Schema of an object with
+// properties, limited to form_schema_keywords at its top level: submissions are only checked for required fields
+// and, with additionalProperties false, for fields the form doesn't ask for. See check_form_fields.
+func (t *SimpleChaincode) register_form_template(stub StubInterface, caller string, template_id string, version string, language string, schema string) ([]byte, error) {
+
+	err := check_ids(stub, template_id, version)
+	if err != nil { return nil, err }
+
+	_, err = parse_form_schema([]byte(schema))
+	if err != nil { return nil, err }
+
+	var keywords map[string]json.RawMessage
+	err = json.Unmarshal([]byte(schema), &keywords)
+	if err != nil { return nil, new_error(ERR_VALIDATION, "Invalid form schema", err.Error()) }
+	for keyword := range keywords {
+		if !form_schema_keywords[keyword] {
+			return nil, new_error(ERR_VALIDATION, "Invalid form schema: unsupported keyword", keyword)
+		}
+	}
+
+	key := form_template_key(template_id, version)
+	bytes, err := stub.GetState(key)
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) > 0 {
+		return nil, new_error(ERR_DUPLICATE, "Duplicate FormTemplate record")
+	}
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	template := FormTemplate{ TemplateId:template_id, Version:version, Language:language, Schema:json.RawMessage(schema), RegisteredBy:caller, RegisteredAt:now }
+
+	bytes, err = json.Marshal(template)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating FormTemplate record") }
+
+	err = stub.PutState(key, bytes)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to put the state")
+	}
+
+	return nil, nil
+
+}
+
+// migrate_keys moves up to limit records (0 for all) from the "/" separated keys written by earlier versions of this
+// chaincode to composite keys, rewriting index and pointer values on the way. Run it until More is false.
+func (t *SimpleChaincode) migrate_keys(stub StubInterface, limit int) ([]byte, error) {
+
+	// range queries only return simple keys, which are the legacy ones
+	keysIter, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Unable to start the iterator")
+	}
+
+	defer keysIter.Close()
+
+	report := MigrationReport{ Skipped:[]string{} }
+
+	for keysIter.HasNext() {
+		if limit > 0 && report.Migrated >= limit {
+			report.More = true
+			break
+		}
+
+		key, val, iterErr := keysIter.Next()
+		if iterErr != nil {
+			return nil, new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
+		}
+
+		new_key, pointer := convert_legacy_key(key)
+		if new_key == "" {
+			report.Skipped = append(report.Skipped, key)
+			continue
+		}
+		if pointer {
+			new_val, _ := convert_legacy_key(string(val))
+			if new_val == "" {
+				report.Skipped = append(report.Skipped, key)
+				continue
+			}
+			val = []byte(new_val)
+		}
+
+		err = stub.PutState(new_key, val)
+		if err != nil {
+			return nil, new_error(ERR_STORAGE, "Unable to put the state")
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return nil, new_error(ERR_STORAGE, "Unable to delete the state")
+		}
+		report.Migrated++
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating MigrationReport record") }
+
+	return bytes, nil
+
+}
+
+// repair_indexes fixes every issue verify_indexes reports, rebuilding the index and pointer keys from the D/ data records
+// and CUSTID/ holders, and returns the issues it fixed.
+func (t *SimpleChaincode) repair_indexes(stub StubInterface) ([]byte, error) {
+	return t.check_indexes(stub, true)
+}
+
+//=================================================================================================================================
+//	 check_indexes - Cross-checks the keys derived from the primary records against them: every D/ record against its five
+//					 index keys and its entry in the history, every index and DH/ key against its D/ record, and the CUSTREF/
+//					 pointers against the CUSTID/ holders listing them. With repair set, each issue found is fixed as well.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_indexes(stub StubInterface, repair bool) ([]byte, error) {
+
+	report := IndexReport{ Issues:[]IndexIssue{}, Repaired:repair }
+
+	// issue records a problem with key and, when repairing, fixes it by writing value to key, or deleting key if value is nil
+	issue := func(key string, problem string, detail string, value []byte) error {
+		object_type, ids := split_key(key)
+		report.Issues = append(report.Issues, IndexIssue{ ObjectType:object_type, Ids:ids, Problem:problem, Detail:detail })
+		if !repair {
+			return nil
+		}
+		if value == nil {
+			err := stub.DelState(key)
+			if err != nil { return new_error(ERR_STORAGE, "Unable to delete the state") }
+			return nil
+		}
+		err := stub.PutState(key, value)
+		if err != nil { return new_error(ERR_STORAGE, "Unable to put the state") }
+		return nil
+	}
+
+	// every data record has its five index keys pointing to it, and its current version in the history
+	_, err := range_page(stub, make_key("D"), Page{}, func(data_key string, val []byte) error {
+		report.Checked++
+
+		customer_id, receiver_id, sender_id := parse_key(data_key)
+		_, scr_key, src_key, rsc_key, csr_key, crs_key := create_keys(customer_id, receiver_id, sender_id)
+
+		for _, key := range []string{scr_key, src_key, rsc_key, csr_key, crs_key} {
+			index, err := stub.GetState(key)
+			if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+			if len(index) == 0 {
+				err = issue(key, "missing", "", []byte(data_key))
+			} else if string(index) != data_key {
+				err = issue(key, "mismatch", "", []byte(data_key))
+			}
+			if err != nil { return err }
+		}
+
+		version := read_data_version(val)
+		if key_id := version_key_id(version); len(key_id) > 0 {
+			key := key_id_key(receiver_id, key_id, sender_id, customer_id)
+			index, err := stub.GetState(key)
+			if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+			if len(index) == 0 {
+				err = issue(key, "missing", "", []byte(data_key))
+			} else if string(index) != data_key {
+				err = issue(key, "mismatch", "", []byte(data_key))
+			}
+			if err != nil { return err }
+		}
+
+		if version.Version == 0 {
+			return nil
+		}
+		key := history_key(customer_id, receiver_id, sender_id, version.Version)
+		history, err := stub.GetState(key)
+		if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		if len(history) == 0 {
+			return issue(key, "missing", "", val)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	// index keys and earlier versions whose data record is gone
+	for _, object_type := range []string{"SCR", "SRC", "RSC", "CSR", "CRS", "DH"} {
+		_, err = range_page(stub, make_key(object_type), Page{}, func(key string, val []byte) error {
+			data_key := convert_key("data_key", key)
+			if object_type == "DH" {
+				_, ids := split_key(key)
+				if len(ids) != 4 {
+					return issue(key, "orphan", "", nil)
+				}
+				data_key = make_key("D", ids[0], ids[1], ids[2])
+			}
+			data, err := stub.GetState(data_key)
+			if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+			if len(data) == 0 {
+				return issue(key, "orphan", "", nil)
+			}
+			return nil
+		})
+		if err != nil { return nil, err }
+	}
+
+	// key ID index keys whose data record is gone or is now encrypted to another key
+	_, err = range_page(stub, make_key("KID"), Page{}, func(key string, val []byte) error {
+		_, ids := split_key(key)
+		if len(ids) != 4 {
+			return issue(key, "orphan", "", nil)
+		}
+		data, err := stub.GetState(get_key("data_key", ids[3], ids[0], ids[2]))
+		if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+		if len(data) == 0 {
+			return issue(key, "orphan", "", nil)
+		}
+		if key_id := version_key_id(read_data_version(data)); key_id != ids[1] {
+			return issue(key, "stale", key_id, nil)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	// the customers listing each crossref in their CUSTID/ holder, in key order
+	holders := map[string]CustRef_Holder{}
+	owners := map[string][]string{}
+
+	_, err = range_page(stub, make_key("CUSTID"), Page{}, func(key string, val []byte) error {
+		report.Checked++
+
+		_, ids := split_key(key)
+		var cust_refs CustRef_Holder
+		err := json.Unmarshal(val, &cust_refs)
+		if err != nil || len(ids) != 1 { return new_error(ERR_INTERNAL, "Corrupt CustRef record", strconv.Quote(key), string(val)) }
+
+		holders[ids[0]] = cust_refs
+		for _, ref := range cust_refs.CustRefs {
+			ref_key := custref_key(ref.EntityId, ref.CustomerRef)
+			owners[ref_key] = append(owners[ref_key], ids[0])
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	// the customer each CUSTREF/ pointer points to; pointers no holder lists are orphans
+	pointers := map[string]string{}
+
+	_, err = range_page(stub, make_key("CUSTREF"), Page{}, func(key string, val []byte) error {
+		_, ids := split_key(string(val))
+		if len(ids) == 1 {
+			pointers[key] = ids[0]
+		}
+		if len(owners[key]) == 0 {
+			return issue(key, "orphan", "", nil)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	// every listed crossref has a pointer to one customer listing it; the other customers listing it lose their entry.
+	// Go through them in key order so that every peer comes to the same result.
+	var ref_keys []string
+	for ref_key := range owners {
+		ref_keys = append(ref_keys, ref_key)
+	}
+	sort.Strings(ref_keys)
+
+	duplicates := map[string][]CustRef{}
+	var duplicate_customers []string
+
+	for _, ref_key := range ref_keys {
+		customers := owners[ref_key]
+		owner := customers[0]
+		pointer, found := pointers[ref_key]
+		for _, customer_id := range customers {
+			if found && customer_id == pointer {
+				owner = pointer
+			}
+		}
+
+		if !found {
+			err = issue(ref_key, "missing", "", []byte(custid_key(owner)))
+		} else if pointer != owner {
+			err = issue(ref_key, "mismatch", "", []byte(custid_key(owner)))
+		}
+		if err != nil { return nil, err }
+
+		_, ids := split_key(ref_key)
+		for _, customer_id := range customers {
+			if customer_id == owner {
+				continue
+			}
+			if len(duplicates[customer_id]) == 0 {
+				duplicate_customers = append(duplicate_customers, customer_id)
+			}
+			duplicates[customer_id] = append(duplicates[customer_id], CustRef{ EntityId:ids[0], CustomerRef:ids[1] })
+		}
+	}
+
+	sort.Strings(duplicate_customers)
+	for _, customer_id := range duplicate_customers {
+		var kept CustRef_Holder
+		for _, ref := range holders[customer_id].CustRefs {
+			duplicate := false
+			for _, dropped := range duplicates[customer_id] {
+				duplicate = duplicate || ref == dropped
+			}
+			if !duplicate {
+				kept.CustRefs = append(kept.CustRefs, ref)
+			}
+		}
+
+		var value []byte
+		if len(kept.CustRefs) > 0 {
+			value, err = json.Marshal(kept)
+			if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating CustRef record") }
+		}
+
+		for _, ref := range duplicates[customer_id] {
+			err = issue(custid_key(customer_id), "duplicate", ref.EntityId + " " + ref.CustomerRef, value)
+			if err != nil { return nil, err }
+		}
+	}
+
+	bytes, err := json.Marshal(report)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating IndexReport record") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 Query functions
+//=================================================================================================================================
+
+func (t *SimpleChaincode) get_customer(stub StubInterface, caller string, customer_id string, receiver_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, receiver_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("D", receiver_id, customer_id), page, 0)
+
+}
+
+func (t *SimpleChaincode) get_customers_by_sender_id(stub StubInterface, caller string, sender_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("SCR", sender_id), page, 0)
+}
+
+func (t *SimpleChaincode) get_customers_by_receiver_id(stub StubInterface, caller string, receiver_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, receiver_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, receiver_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("D", receiver_id), page, 0)
+
+}
+
+// get_customer_sharing_map lists every sender -> receiver flow of the customer's data, without the data itself.
+// Consent managers, who answer the customer's "who has my data?", and regulators get every flow. Any other entity
+// holding a consent from the customer only gets the flows it sends or receives.
+func (t *SimpleChaincode) get_customer_sharing_map(stub StubInterface, caller string, customer_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, customer_id)
+	if err != nil { return nil, err }
+
+	full_map := check_role(stub, caller, ROLE_CONSENT_MANAGER, ROLE_REGULATOR) == nil
+	if !full_map {
+		related, err := customer_related(stub, customer_id, caller)
+		if err != nil { return nil, err }
+		if !related {
+			return nil, new_error(ERR_UNAUTHORIZED, "Permission denied", caller)
+		}
+	}
+
+	sharing_map := SharingMap{ CustomerId:customer_id, Flows:[]SharingFlow{} }
+
+	sharing_map.Next, err = range_page(stub, make_key("CSR", customer_id), page, func(key string, val []byte) error {
+
+		customer_id, receiver_id, sender_id := parse_key(key)
+		if !full_map && caller != sender_id && caller != receiver_id {
+			return nil
+		}
+
+		visible, err := data_visible(stub, customer_id, receiver_id, sender_id)
+		if err != nil || !visible { return err }
+
+		sharing_map.Flows = append(sharing_map.Flows, SharingFlow{ SenderId:sender_id, ReceiverId:receiver_id })
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(sharing_map)
+	if err != nil {
+		return nil, new_error(ERR_INTERNAL, "Error creating SharingMap record")
+	}
+	return bytes, nil
+}
+
+// get_customer_by_sender returns the customer's data shared by sender_id with any receiver, using the CSR index.
+func (t *SimpleChaincode) get_customer_by_sender(stub StubInterface, caller string, customer_id string, sender_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("CSR", customer_id, sender_id), page, 0)
+}
+
+// get_customers_by_sender_and_receiver returns every customer's data sent from sender_id to receiver_id, using the SRC index.
+func (t *SimpleChaincode) get_customers_by_sender_and_receiver(stub StubInterface, caller string, sender_id string, receiver_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, sender_id, receiver_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id, receiver_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("SRC", sender_id, receiver_id), page, 0)
+}
+
+// get_customers_by_receiver_and_sender returns every customer's data received by receiver_id from sender_id, using the RSC index.
+func (t *SimpleChaincode) get_customers_by_receiver_and_sender(stub StubInterface, caller string, receiver_id string, sender_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id, receiver_id)
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("RSC", receiver_id, sender_id), page, 0)
+}
+
+// get_records_by_key_id lists the current data received by receiver_id that is encrypted to the receiver's key key_id,
+// so that after a key rotation its senders can re-submit it encrypted to the new key. With sender_id, only the data
+// from that sender is listed, and the sender may ask as well as the receiver.
+func (t *SimpleChaincode) get_records_by_key_id(stub StubInterface, caller string, receiver_id string, key_id string, sender_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, receiver_id)
+	if err != nil { return nil, err }
+	if !key_id_pattern.MatchString(key_id) {
+		return nil, new_error(ERR_VALIDATION, "Invalid key ID", key_id)
+	}
+
+	attributes := []string{receiver_id, key_id}
+	if len(sender_id) == 0 {
+		err = check_caller(caller, receiver_id)
+	} else {
+		err = check_ids(stub, sender_id)
+		if err != nil { return nil, err }
+		err = check_caller(caller, sender_id, receiver_id)
+		attributes = append(attributes, sender_id)
+	}
+	if err != nil { return nil, err }
+
+	return get_customers_in_range(stub, make_key("KID", attributes...), page, 0)
+}
+
+// get_customer_content returns the same result as get_customer with the Content of the data, under the access record
+// access_customer committed in transaction access_tx_id. Queries only read committed state, so there is no reading
+// Content without a record of it. A record covers the data as it was when it was recorded: Content of data
+// registered after it is left out.
+func (t *SimpleChaincode) get_customer_content(stub StubInterface, caller string, customer_id string, receiver_id string, access_tx_id string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, receiver_id)
+	if err != nil { return nil, err }
+
+	var access *AccessRecord
+	_, err = range_page(stub, make_key("ACCESS", "C", customer_id), Page{}, func(key string, val []byte) error {
+		var record AccessRecord
+		err := json.Unmarshal(val, &record)
+		if err != nil { return new_error(ERR_INTERNAL, "Corrupt AccessRecord record", string(val)) }
+		if record.TxId == access_tx_id && record.AccessorId == caller && record.ReceiverId == receiver_id {
+			access = &record
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	if access == nil {
+		return nil, new_error(ERR_NOT_FOUND, "Access record not found", access_tx_id)
+	}
+
+	return get_customers_in_range(stub, make_key("D", receiver_id, customer_id), Page{}, access.AccessedAt)
+}
+
+// get_customer_history returns every version of the data shared from sender_id to receiver_id for the customer, oldest
+// first, without their Content: get_customer_content returns that of the current version.
+func (t *SimpleChaincode) get_customer_history(stub StubInterface, caller string, customer_id string, receiver_id string, sender_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, sender_id, receiver_id)
+	if err != nil { return nil, err }
+
+	visible, err := data_visible(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	history := DataVersion_Holder{ Versions:[]DataVersion{} }
+	if !visible {
+		return json.Marshal(history)
+	}
+
+	history.Next, err = range_page(stub, history_prefix(customer_id, receiver_id, sender_id), page, func(key string, val []byte) error {
+		version := read_data_version(val)
+		version.Opaque, version.Content = false, nil
+		history.Versions = append(history.Versions, version)
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(history)
+	if err != nil {
+		return nil, new_error(ERR_INTERNAL, "Error creating DataVersion record")
+	}
+	return bytes, nil
+}
+
+// get_erasure_certificates lists the erasures of the customer's data, in transaction ID order.
+// Certificates hold no customer data, but tell who held it, so only regulators may check them.
+func (t *SimpleChaincode) get_erasure_certificates(stub StubInterface, customer_id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, customer_id)
+	if err != nil { return nil, err }
+
+	certificates := ErasureCertificate_Holder{ Certificates:[]ErasureCertificate{} }
+
+	certificates.Next, err = range_page(stub, make_key("ERASURE", customer_id), page, func(key string, val []byte) error {
+		var certificate ErasureCertificate
+		err := json.Unmarshal(val, &certificate)
+		if err != nil { return new_error(ERR_INTERNAL, "Corrupt ErasureCertificate record", string(val)) }
+		certificates.Certificates = append(certificates.Certificates, certificate)
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(certificates)
+	if err != nil {
+		return nil, new_error(ERR_INTERNAL, "Error creating ErasureCertificate record")
+	}
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) get_form_template(stub StubInterface, template_id string, version string) ([]byte, error) {
+
+	err := check_ids(stub, template_id, version)
+	if err != nil { return nil, err }
+
+	key := form_template_key(template_id, version)
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())
+	}
+	if len(bytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Form template not found", key)
+	}
+
+	return bytes, nil
+}
+
+// verify_indexes reports the index and pointer keys that are out of step with the records they are derived from.
+func (t *SimpleChaincode) verify_indexes(stub StubInterface) ([]byte, error) {
+	return t.check_indexes(stub, false)
+}
+
+// export_state returns the ledger's records, by object type in the order of object_types and in key order within each.
+// prefix limits the export to one object type, optionally followed by leading IDs, "/" separated: "D" or "D/bank2".
+// Keys left from before migrate_keys are not exported.
+func (t *SimpleChaincode) export_state(stub StubInterface, prefix string, page Page) ([]byte, error) {
+
+	types := object_types
+	var ids []string
+	if len(prefix) > 0 {
+		parts := strings.Split(prefix, "/")
+		known := false
+		for _, object_type := range object_types {
+			known = known || parts[0] == object_type
+		}
+		if !known {
+			return nil, new_error(ERR_VALIDATION, "Unknown object type", parts[0])
+		}
+		types = parts[:1]
+		ids = parts[1:]
+		err := check_ids(stub, ids...)
+		if err != nil { return nil, err }
+	}
+
+	// the token is the object type to go on with, "/", then the bookmark within it, see range_page
+	first := 0
+	bookmark := ""
+	if len(page.Token) > 0 {
+		parts := strings.SplitN(page.Token, "/", 2)
+		for first < len(types) && types[first] != parts[0] {
+			first++
+		}
+		if len(parts) != 2 || first == len(types) {
+			return nil, new_error(ERR_VALIDATION, "Invalid continuation token")
+		}
+		bookmark = parts[1]
+	}
+
+	export := StateExport{ Entries:[]StateEntry{} }
+
+	for i := first; i < len(types); i++ {
+		type_page := Page{}
+		if page.Limit > 0 {
+			type_page.Limit = page.Limit - len(export.Entries)
+		}
+		if i == first {
+			type_page.Token = bookmark
+		}
+
+		next, err := range_page(stub, make_key(types[i], ids...), type_page, func(key string, val []byte) error {
+			object_type, _ := split_key(key)
+			value, opaque := encode_content(string(val))
+			export.Entries = append(export.Entries, StateEntry{ Key:key, Type:object_type, Value:value, Opaque:opaque })
+			return nil
+		})
+		if err != nil { return nil, err }
+
+		if len(next) > 0 {
+			export.Next = types[i] + "/" + next
+			break
+		}
+		// a full page goes on with the next object type
+		if page.Limit > 0 && len(export.Entries) == page.Limit {
+			if i + 1 < len(types) {
+				export.Next = types[i + 1] + "/"
+			}
+			break
+		}
+	}
+
+	bytes, err := json.Marshal(export)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating StateExport record") }
+
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) get_customer_crossref(stub StubInterface, caller string, entity_id string, customer_ref string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id, customer_ref)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, entity_id)
+	if err != nil { return nil, err }
+
+	key:=custref_key(entity_id, customer_ref)
+	datakeyAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Failed to get state", key)
+	}
+	if len(datakeyAsbytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "CustRef not found", key)
+	}
+	datakey:=string(datakeyAsbytes)
+	valAsbytes, err := stub.GetState(datakey)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Failed to get state", datakey)
+	}
+
+	// the holder lists the refs of every entity, which are theirs to keep; only the caller's own are returned
+	var cust_refs CustRef_Holder
+	if len(valAsbytes) > 0 {
+		err = json.Unmarshal(valAsbytes, &cust_refs)
+		if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record", err.Error(), string(valAsbytes)) }
+	}
+	own_refs := CustRef_Holder{ CustRefs:[]CustRef{} }
+	for _, ref := range cust_refs.CustRefs {
+		if ref.EntityId == entity_id {
+			own_refs.CustRefs = append(own_refs.CustRefs, ref)
+		}
+	}
+
+	bytes, err := json.Marshal(own_refs)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating CustRef record") }
+
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) get_customer_id_by_crossref(stub StubInterface, caller string, entity_id string, customer_ref string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id, customer_ref)
+	if err != nil { return nil, err }
+
+	err = check_caller(caller, entity_id)
+	if err != nil { return nil, err }
+
+	key:=custref_key(entity_id, customer_ref)
+	datakeyAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Failed to get state", key)
+	}
+	if len(datakeyAsbytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "CustRef not found", key)
+	}
+	datakey:=string(datakeyAsbytes)
+	_, ids := split_key(datakey)
+	if len(ids) != 1 {
+		return nil, new_error(ERR_INTERNAL, "Corrupt CustRef record", datakey)
+	}
+	customer_id := ids[0]
+
+	return []byte(customer_id), nil
+}
+
+// get_entity returns one entity's record, so that senders can find the key to encrypt to without listing every entity.
+func (t *SimpleChaincode) get_entity(stub StubInterface, entity_id string) ([]byte, error) {
+
+	err := check_ids(stub, entity_id)
+	if err != nil { return nil, err }
+
+	bytes, err := stub.GetState(entity_key(entity_id))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Entity not found", entity_id)
+	}
+
+	return bytes, nil
+}
+
+// export_entities returns every registered entity as an EntityDirectory for import_entities.
+func (t *SimpleChaincode) export_entities(stub StubInterface, caller string) ([]byte, error) {
+
+	now, err := get_tx_time(stub)
+	if err != nil { return nil, err }
+
+	snapshot := EntityDirectory{ ExportedBy:caller, ExportedAt:now, TxId:stub.GetTxID(), Entities:[]Entity{} }
+
+	_, err = range_page(stub, make_key("ENTID"), Page{}, func(key string, val []byte) error {
+		var entity Entity
+		err := json.Unmarshal(val, &entity)
+		if err != nil { return new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(val)) }
+		snapshot.Entities = append(snapshot.Entities, entity)
+		return nil
+	})
+	if err != nil { return nil, err }
+	snapshot.Count = len(snapshot.Entities)
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Error creating EntityDirectory record") }
+
+	return bytes, nil
+}
+
+func (t *SimpleChaincode) get_all_entities(stub StubInterface, page Page) ([]byte, error) {
+
+	entities := Entity_Holder{ Entities:[]Entity{} }
+	var err error
+
+	entities.Next, err = range_page(stub, make_key("ENTID"), page, func(key string, val []byte) error {
+		var ent Entity
+		err := json.Unmarshal(val,&ent)
+		if err != nil { return new_error(ERR_INTERNAL, "Error creating Entity record") }
+		entities.Entities = append(entities.Entities,ent)
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(entities)
+	if err != nil {
+		return nil, new_error(ERR_INTERNAL, "Error creating Entities record")
+	}
+	return []byte(bytes), nil
+}
+
+func (t *SimpleChaincode) get_consent(stub StubInterface, caller string, customer_id string, receiver_id string, sender_id string) ([]byte, error) {
+
+	err := check_ids(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return nil, err }
+
+	// consent managers grant and revoke consents for the customer, regulators audit them
+	err = check_caller(caller, sender_id, receiver_id)
+	if err != nil {
+		err = check_role(stub, caller, ROLE_CONSENT_MANAGER, ROLE_REGULATOR)
+	}
+	if err != nil { return nil, err }
+
+	key := consent_key(customer_id, receiver_id, sender_id)
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error())
+	}
+	if len(bytes) == 0 {
+		return nil, new_error(ERR_NOT_FOUND, "Consent not found", key)
+	}
+
+	return bytes, nil
+}
+
+// get_access_log lists access records either by customer (log_type "customer") or by accessing entity (log_type "entity").
+// An entity may read its own log, and the records of a customer's log for the flows it is party to: its own reads,
+// and the reads of data it sent. Regulators and consent managers, who act for the customer, read whole logs.
+func (t *SimpleChaincode) get_access_log(stub StubInterface, caller string, log_type string, id string, page Page) ([]byte, error) {
+
+	err := check_ids(stub, id)
+	if err != nil { return nil, err }
+
+	var prefix string
+	full_log := true
+
+	switch log_type {
+	case "customer":
+		full_log = check_role(stub, caller, ROLE_REGULATOR, ROLE_CONSENT_MANAGER) == nil
+		if !full_log {
+			related, err := customer_related(stub, id, caller)
+			if err != nil { return nil, err }
+			if !related {
+				return nil, new_error(ERR_UNAUTHORIZED, "Permission denied", caller)
+			}
+		}
+		prefix = make_key("ACCESS", "C", id)
+	case "entity":
+		err := check_caller(caller, id)
+		if err != nil {
+			err = check_role(stub, caller, ROLE_REGULATOR)
+		}
+		if err != nil { return nil, err }
+		prefix = make_key("ACCESS", "E", id)
+	default:
+		return nil, new_error(ERR_VALIDATION, "Invalid log type", log_type)
+	}
+
+	entries := AccessRecord_Holder{ Entries:[]AccessRecord{} }
+
+	entries.Next, err = range_page(stub, prefix, page, func(key string, val []byte) error {
+		var err error
+		// the entity log holds pointers to the records in the customer log
+		if log_type == "entity" {
+			val, err = stub.GetState(string(val))
+			if err != nil {
+				return new_error(ERR_STORAGE, "Error in GetState", err.Error())
+			}
+		}
+		var ent AccessRecord
+		err = json.Unmarshal(val, &ent)
+		if err != nil { return new_error(ERR_INTERNAL, "Corrupt AccessRecord record", string(val)) }
+		// a read covers the data of every sender to the receiver, so a sender is party to it if it sent any
+		if !full_log && ent.ReceiverId != caller {
+			consent, err := get_consent_record(stub, ent.CustomerId, ent.ReceiverId, caller)
+			if err != nil || consent == nil { return err }
+		}
+		entries.Entries = append(entries.Entries, ent)
+		return nil
+	})
+	if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(entries)
+	if err != nil {
+		return nil, new_error(ERR_INTERNAL, "Error creating AccessRecord record")
+	}
+	return bytes, nil
+}
+
+// consent_active returns true if the customer has consented to sharing data from sender_id to receiver_id
+// and that consent has neither been revoked nor expired at the time of the current transaction.
+func (t *SimpleChaincode) consent_active(stub StubInterface, customer_id string, receiver_id string, sender_id string) (bool, error) {
+
+	status, err := consent_status(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return false, err }
+
+	return status == "active", nil
+}
+
+
+//=================================================================================================================================
+//	 Utility functions
+//=================================================================================================================================
+// make_key returns the composite key of object_type and attributes made by the shim's CreateCompositeKey:
+// "\x00" + object_type + "\x00" + each attribute + "\x00". Given fewer attributes than a full key, it returns the prefix
+// of every key starting with them. It returns "", which the peer rejects as a key, for attributes that can't be part
+// of a key; check_ids rejects such IDs before any key is made from them.
+func make_key(object_type string, attributes ...string) (string) {
+	key, err := shim.CreateCompositeKey(object_type, attributes)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// split_key returns the object type and attributes of a key made by make_key, or "" and nil for any other key.
+func split_key(key string) (object_type string, attributes []string) {
+	if len(key) < 2 || !strings.HasPrefix(key, KEY_SEPARATOR) || !strings.HasSuffix(key, KEY_SEPARATOR) {
+		return "", nil
+	}
+	str := strings.Split(key[1:len(key) - 1], KEY_SEPARATOR)
+	return str[0], str[1:]
+}
+
+func entity_key(entity_id string) (string) {
+	return make_key("ENTID", entity_id)
+}
+
+func custid_key(customer_id string) (string) {
+	return make_key("CUSTID", customer_id)
+}
+
+func custref_key(entity_id string, customer_ref string) (string) {
+	return make_key("CUSTREF", entity_id, customer_ref)
+}
+
+func create_keys(customer_id string, receiver_id string, sender_id string) (data_key, scr_key, src_key, rsc_key, csr_key, crs_key string) {
+	data_key = get_key("data_key", customer_id, receiver_id, sender_id)
+	scr_key = get_key("scr_key", customer_id, receiver_id, sender_id)
+	src_key = get_key("src_key", customer_id, receiver_id, sender_id)
+	rsc_key = get_key("rsc_key", customer_id, receiver_id, sender_id)
+	csr_key = get_key("csr_key", customer_id, receiver_id, sender_id)
+	crs_key = get_key("crs_key", customer_id, receiver_id, sender_id)
+	return
+}
+
+func get_key(key_type string, customer_id string, receiver_id string, sender_id string) (string) {
+
+	switch key_type {
+	case "data_key" :
+		return make_key("D", receiver_id, customer_id, sender_id)
+	case "scr_key" :
+		return make_key("SCR", sender_id, customer_id, receiver_id)
+	case "src_key" :
+		return make_key("SRC", sender_id, receiver_id, customer_id)
+	case "rsc_key" :
+		return make_key("RSC", receiver_id, sender_id, customer_id)
+	case "csr_key" :
+		return make_key("CSR", customer_id, sender_id, receiver_id)
+	case "crs_key" :
+		return make_key("CRS", customer_id, receiver_id, sender_id)
+	}
+	return ""
+}
+
+func convert_key(key_type string, current_key string) (string) {
 
-	err = stub.PutState(key, bytes)
-	if err != nil { return nil, errors.New("Unable to put the state") }
+	customer_id, receiver_id, sender_id := parse_key(current_key)
+	return get_key(key_type, customer_id, receiver_id, sender_id)
 
-	// register ref key
-	ref_key := "CUSTREF/"+entity_id+"/"+customer_ref
+}
 
-	err = stub.PutState(ref_key, []byte(key))
-	if err != nil { return nil, errors.New("Unable to put the state") }
-	return nil, nil
+func parse_key(key string) (customer_id string, receiver_id string, sender_id string) {
+	key_type, str := split_key(key)
+	if len(str) != 3 {
+		return "", "", ""
+	}
 
+	switch key_type {
+	case "D" :
+		receiver_id = str[0]; customer_id = str[1]; sender_id = str[2]
+	case "SCR" :
+		sender_id = str[0]; customer_id = str[1]; receiver_id = str[2]
+	case "SRC" :
+		sender_id = str[0]; receiver_id = str[1]; customer_id = str[2]
+	case "RSC" :
+		receiver_id = str[0]; sender_id = str[1]; customer_id = str[2]
+	case "CSR" :
+		customer_id = str[0]; sender_id = str[1]; receiver_id = str[2]
+	case "CRS" :
+		customer_id = str[0]; receiver_id = str[1]; sender_id = str[2]
+	}
+	return customer_id , receiver_id , sender_id
 }
 
-func (t *SimpleChaincode) delete_customer_crossref(stub *shim.ChaincodeStub, entity_id string, customer_ref string) ([]byte, error) {
+// check_caller returns an error unless the caller is one of the allowed entities.
+func check_caller(caller string, allowed ...string) error {
+	for _, entity_id := range allowed {
+		if caller == entity_id {
+			return nil
+		}
+	}
+	return new_error(ERR_UNAUTHORIZED, "Permission denied", caller)
+}
 
+// check_role returns nil if caller is a registered entity holding one of roles, or any role if none are given.
+func check_role(stub StubInterface, caller string, roles ...string) error {
 
-	if(!valid_key(entity_id)||!valid_key(customer_ref)){
-		return nil, errors.New("Invalid arguments")
+	bytes, err := stub.GetState(entity_key(caller))
+	if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return new_error(ERR_UNAUTHORIZED, "Caller is not a registered entity", caller)
 	}
-
-	ckey:="CUSTREF/"+entity_id+"/"+customer_ref
-	datakeyAsbytes, err := stub.GetState(ckey)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + ckey + "\"}"
-		return nil, errors.New(jsonResp)
+	if len(roles) == 0 {
+		return nil
 	}
 
-	key:=string(datakeyAsbytes)
+	var entity Entity
+	err = json.Unmarshal(bytes, &entity)
+	if err != nil { return new_error(ERR_INTERNAL, "Corrupt Entity record", err.Error(), string(bytes)) }
 
-	//key := "CUSTID/"+customer_id
-	bytes, err := stub.GetState(key)
-	if err != nil {
-		return nil, errors.New("Corrupt CustRef record / customer record not found")
+	for _, role := range roles {
+		if has_role(entity_roles(entity), role) {
+			return nil
+		}
 	}
+	return new_error(ERR_UNAUTHORIZED, "Permission denied", caller + " is not " + strings.Join(roles, " or "))
+}
 
-	var cust_refs CustRef_Holder
-	err = json.Unmarshal(bytes, &cust_refs)
-	if err != nil {	return nil, errors.New("Corrupt CustRef record:" + string(bytes)) }
+// entity_roles returns the entity's roles; entities registered before roles hold DEFAULT_ROLES.
+func entity_roles(entity Entity) []string {
+	if len(entity.Roles) == 0 {
+		return DEFAULT_ROLES
+	}
+	return entity.Roles
+}
 
-	//find entry
-	for i := len(cust_refs.CustRefs) - 1; i >= 0; i-- {
-		ref:=cust_refs.CustRefs[i]
-		if (ref.CustomerRef == customer_ref && ref.EntityId == entity_id) {
-			// found, take this element from cust_ref
-			cust_refs.CustRefs = append(cust_refs.CustRefs[:i],cust_refs.CustRefs[i+1:]...)
-			break
+// parse_roles parses comma separated roles into a sorted list without duplicates.
+func parse_roles(roles string) ([]string, error) {
+	var parsed []string
+	for _, role := range strings.Split(roles, ",") {
+		role = strings.TrimSpace(role)
+		if !has_role(all_roles, role) {
+			return nil, new_error(ERR_VALIDATION, "Unknown role", role)
 		}
+		parsed = append(parsed, role)
 	}
+	return sorted_roles(parsed), nil
+}
 
-	if len(cust_refs.CustRefs) == 0 {
-		err = stub.DelState(key)
-		if err != nil { return nil, errors.New("Unable to delete the state") }
-	} else {
-		bytes, err = json.Marshal(cust_refs)
-		if err != nil {
-			return nil, errors.New("Error creating CustRef record")
+// sorted_roles returns the known roles among roles, in the order of all_roles.
+func sorted_roles(roles []string) []string {
+	var sorted []string
+	for _, role := range all_roles {
+		if has_role(roles, role) {
+			sorted = append(sorted, role)
 		}
+	}
+	return sorted
+}
 
-		err = stub.PutState(key, bytes)
-		if err != nil {
-			return nil, errors.New("Unable to put the state")
+func has_role(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
 		}
 	}
-	// delete ref key
-	ref_key := "CUSTREF/"+entity_id+"/"+customer_ref
-
-	err = stub.DelState(ref_key)
-	if err != nil { return nil, errors.New("Unable to delete the state") }
-	return nil, nil
-
+	return false
 }
 
-func (t *SimpleChaincode) register_entity(stub *shim.ChaincodeStub, entity_id string, entity_name string, entity_public_key string) ([]byte, error) {
+// has_received_data tells whether customer data was sent to the entity, which then can't change its key but by rotation.
+func has_received_data(stub StubInterface, entity_id string) (bool, error) {
+	keysIter, err := stub.GetStateByPartialCompositeKey("D", []string{entity_id})
+	if err != nil { return false, new_error(ERR_STORAGE, "Unable to start the iterator") }
+	defer keysIter.Close()
+	return keysIter.HasNext(), nil
+}
 
-	if(!valid_key(entity_id)||len(entity_public_key)==0){
-		return nil, errors.New("Invalid arguments")
+// can_bootstrap tells whether caller is the admin named to Init and no entity holds the admin role yet. While neither
+// exists, it returns an error.
+func can_bootstrap(stub StubInterface, caller string) (bool, error) {
+	config, err := get_config(stub)
+	if err != nil { return false, err }
+	if len(config.AdminId) > 0 && caller != config.AdminId {
+		return false, nil
+	}
+	bootstrap, err := no_admins(stub)
+	if err != nil { return false, err }
+	// without an admin to start from, nothing could ever be registered: say why rather than just refusing
+	if bootstrap && len(config.AdminId) == 0 {
+		return false, new_error(ERR_UNAUTHORIZED, "No entity is an admin and Init named no initial admin", "run Init with an initial admin entity ID")
 	}
-	ekey:= "ENTID/"+entity_id
+	return bootstrap, nil
+}
 
+// merge_key_history reconciles the key history of entity, imported by import_entities, with that of the stored record.
+// The ledger's history is never lost: the imported one has to go on from it. With the same key, the stored history
+// and KeyValidFrom are kept; a new key can't be one the entity retired, so that a retired key stays retired.
+func merge_key_history(entity *Entity, stored Entity) error {
 
-	// check if the record already exists.
-	// If exists, further check if customer data that was sent to the entity exists.
-	// You can"t delete or modify the public key if such customer data exists.
-	eval, err := stub.GetState(ekey)
-	if err != nil { return nil, errors.New("Error in GetState: " + err.Error())	}
-	if len(eval) > 0 { //found
-		var entity_existed Entity
-		err = json.Unmarshal(eval, &entity_existed)
-		if err != nil { return nil, errors.New("Corrupt Entity record: " + err.Error() + string(eval))}
-		receiver_id := entity_existed.EntityId
-		keysIter, err := stub.RangeQueryState("D/" + receiver_id + "/" , "D/" + receiver_id + "/" + "|")
-		if err != nil { return nil, errors.New("Unable to start the iterator")}
-		defer keysIter.Close()
-		if keysIter.HasNext() && entity_existed.EntityPublicKey != entity_public_key{
-			return nil, errors.New("You can't modify existing entity record if customer data exists")
+	if len(entity.PreviousKeys) < len(stored.PreviousKeys) && entity.EntityPublicKey != stored.EntityPublicKey {
+		return new_error(ERR_CONFLICT, "The key history conflicts with the ledger", entity.EntityId)
+	}
+	for i := 0; i < len(stored.PreviousKeys) && i < len(entity.PreviousKeys); i++ {
+		if entity.PreviousKeys[i] != stored.PreviousKeys[i] {
+			return new_error(ERR_CONFLICT, "The key history conflicts with the ledger", entity.EntityId)
 		}
 	}
 
-	entity_data:= Entity{ EntityId:entity_id , EntityName:entity_name , EntityPublicKey:entity_public_key }
+	if entity.EntityPublicKey == stored.EntityPublicKey {
+		entity.PreviousKeys = stored.PreviousKeys
+		entity.KeyValidFrom = stored.KeyValidFrom
+		return nil
+	}
+	for _, previous := range stored.PreviousKeys {
+		if previous.KeyId == entity.KeyId {
+			return new_error(ERR_CONFLICT, "The key was used by the entity before", entity.EntityId)
+		}
+	}
+	return nil
+}
 
-	bytes, err := json.Marshal(entity_data)
-	if err != nil { return nil, errors.New("Error creating Entity record") }
+// no_admins tells whether no entity holds the admin role: the ledger is new, or was upgraded from before roles.
+func no_admins(stub StubInterface) (bool, error) {
+	keysIter, err := stub.GetStateByPartialCompositeKey("ENTID", []string{})
+	if err != nil { return false, new_error(ERR_STORAGE, "Unable to start the iterator") }
+	defer keysIter.Close()
 
-	err = stub.PutState(ekey, []byte(bytes))
-	if err != nil {
-		return nil, errors.New("Unable to put the state")
+	for keysIter.HasNext() {
+		key, val, iterErr := keysIter.Next()
+		if iterErr != nil { return false, new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error()) }
+		var entity Entity
+		err = json.Unmarshal(val, &entity)
+		if err != nil { return false, new_error(ERR_INTERNAL, "Corrupt Entity record", strconv.Quote(key)) }
+		if has_role(entity_roles(entity), ROLE_ADMIN) {
+			return false, nil
+		}
 	}
+	return true, nil
+}
 
-	return nil, nil
-
+// canonical_args returns the bytes a submitter signs for function called with args: a JSON array of the
+// function name followed by every argument except the signature itself, e.g. ["delete_entity","bank1"].
+func canonical_args(function string, args ...string) []byte {
+	bytes, _ := json.Marshal(append([]string{function}, args...))
+	return bytes
 }
 
-func (t *SimpleChaincode) delete_entity(stub *shim.ChaincodeStub, entity_id string) ([]byte, error) {
+// parse_public_key parses a PEM encoded PKIX public key. ECDSA P-256 and RSA (2048 bits or more) keys are supported.
+func parse_public_key(public_key string) (crypto.PublicKey, error) {
 
-	if(!valid_key(entity_id)){
-		return nil, errors.New("Invalid arguments")
+	block, _ := pem.Decode([]byte(public_key))
+	if block == nil {
+		return nil, new_error(ERR_VALIDATION, "Public key is not PEM encoded")
 	}
-	ekey:= "ENTID/"+entity_id
 
-	// check if the record already exists.
-	// If exists, further check if customer data that was sent to the entity exists.
-	// You can"t delete or modify the public key if such customer data exists.
-	eval, err := stub.GetState(ekey)
-	if err != nil { return nil, errors.New("Error in GetState: " + err.Error())	}
-	if len(eval) > 0 { //found
-		var entity_existed Entity
-		err = json.Unmarshal(eval, &entity_existed)
-		if err != nil { return nil, errors.New("Corrupt Entity record: " + err.Error() + string(eval))}
-		receiver_id := entity_existed.EntityId
-		keysIter, err := stub.RangeQueryState("D/" + receiver_id + "/" , "D/" + receiver_id + "/" + "|")
-		if err != nil { return nil, errors.New("Unable to start the iterator")}
-		defer keysIter.Close()
-		if keysIter.HasNext() {
-			return nil, errors.New("You can't delete existing entity record if customer data exists")
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, new_error(ERR_VALIDATION, "Unable to parse public key", err.Error())
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, new_error(ERR_VALIDATION, "Unsupported ECDSA curve, P-256 is required")
+		}
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return nil, new_error(ERR_VALIDATION, "RSA key must be at least 2048 bits")
 		}
+	default:
+		return nil, new_error(ERR_VALIDATION, "Unsupported public key type")
 	}
+	return key, nil
+}
 
-	err = stub.DelState(ekey)
+// verify_signature checks a base64 encoded signature over the SHA-256 digest of message.
+// ECDSA signatures are ASN.1 DER encoded, RSA signatures are PKCS #1 v1.5.
+func verify_signature(public_key string, message []byte, signature string) error {
+
+	key, err := parse_public_key(public_key)
+	if err != nil { return err }
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
 	if err != nil {
-		return nil, errors.New("Unable to delete the state")
+		return new_error(ERR_VALIDATION, "Signature is not base64 encoded")
 	}
 
-	return nil, nil
+	digest := sha256.Sum256(message)
 
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var ecdsa_sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &ecdsa_sig)
+		if err != nil || len(rest) != 0 || !ecdsa.Verify(k, digest[:], ecdsa_sig.R, ecdsa_sig.S) {
+			return new_error(ERR_UNAUTHORIZED, "Signature verification failed")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			return new_error(ERR_UNAUTHORIZED, "Signature verification failed")
+		}
+	}
+	return nil
 }
 
-//=================================================================================================================================
-//	 Query functions
-//=================================================================================================================================
-
-func (t *SimpleChaincode) get_customer(stub *shim.ChaincodeStub, customer_id string, receiver_id string) ([]byte, error) {
+func history_prefix(customer_id string, receiver_id string, sender_id string) (string) {
+	return make_key("DH", receiver_id, customer_id, sender_id)
+}
 
-	var entries CustomerData_Holder
-	var ent CustomerData
+func history_key(customer_id string, receiver_id string, sender_id string, version int) (string) {
+	return make_key("DH", receiver_id, customer_id, sender_id, fmt.Sprintf("%010d", version))
+}
 
-	keysIter, err := stub.RangeQueryState("D/" + receiver_id + "/" + customer_id + "/", "D/" + receiver_id + "/" + customer_id + "/" + "~")
+// key_id_key indexes data by the key ID of the receiver's key it is encrypted to, so that senders can find what
+// to re-submit after the receiver rotates its key.
+func key_id_key(receiver_id string, key_id string, sender_id string, customer_id string) (string) {
+	return make_key("KID", receiver_id, key_id, sender_id, customer_id)
+}
 
+// version_key_id returns the key ID the version's content is encrypted to. Versions written before key IDs were
+// recorded take it from the envelope itself; content that is no envelope has none.
+func version_key_id(version DataVersion) (string) {
+	if len(version.KeyId) > 0 || version.Opaque {
+		return version.KeyId
+	}
+	env, err := envelope.Parse(version.Content)
 	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
+		return ""
 	}
+	return env.Kid
+}
 
-	defer keysIter.Close()
-
-	for keysIter.HasNext() {
-		datakeyAsbytes, dataAsBytes, iterErr := keysIter.Next()
-		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
-		}
-		datakey:=string(datakeyAsbytes)
-
-		customer_id , receiver_id, sender_id := parse_key(datakey)
+// read_data_version decodes the value of a D/ or DH/ key. Values written before versioning are returned as Version 0.
+func read_data_version(bytes []byte) (DataVersion) {
+	var version DataVersion
+	err := json.Unmarshal(bytes, &version)
+	if err != nil || version.Version == 0 {
+		content, opaque := encode_content(string(bytes))
+		return DataVersion{ Opaque:opaque, Content:content }
+	}
 
-		ent = CustomerData{ CustomerId:customer_id , ReceiverId:receiver_id, SenderId:sender_id, Content:string(dataAsBytes)}
+	// versions written before Content was stored as JSON hold it as an escaped string
+	var escaped string
+	if !version.Opaque && json.Unmarshal(version.Content, &escaped) == nil {
+		version.Content, version.Opaque = encode_content(escaped)
+	}
+	return version
+}
 
-		entries.Entries = append(entries.Entries,ent)
+// encode_content returns data as raw JSON if it is valid JSON, otherwise as a JSON string flagged as opaque.
+func encode_content(data string) (json.RawMessage, bool) {
+	if json.Valid([]byte(data)) {
+		return json.RawMessage(data), false
 	}
+	quoted, _ := json.Marshal(data)
+	return json.RawMessage(quoted), true
+}
 
-	bytes, err := json.Marshal(entries)
+func form_template_key(template_id string, version string) (string) {
+	return make_key("FORM", template_id, version)
+}
+
+// parse_form_schema checks that schema is a JSON Schema describing a JSON object with named properties.
+func parse_form_schema(schema []byte) (*FormSchema, error) {
+	var form_schema FormSchema
+	err := json.Unmarshal(schema, &form_schema)
 	if err != nil {
-		return nil, errors.New("Error creating CustomerData record")
+		return nil, new_error(ERR_VALIDATION, "Invalid form schema", err.Error())
 	}
-	return []byte(bytes), nil
+	if form_schema.Type != "object" || len(form_schema.Properties) == 0 {
+		return nil, new_error(ERR_VALIDATION, "Invalid form schema: must be of type object with properties")
+	}
+	for _, field := range form_schema.Required {
+		if _, ok := form_schema.Properties[field]; !ok {
+			return nil, new_error(ERR_VALIDATION, "Invalid form schema: required field is not a property", field)
+		}
+	}
+	return &form_schema, nil
+}
 
+func consent_key(customer_id string, receiver_id string, sender_id string) (string) {
+	return make_key("CONSENT", customer_id, receiver_id, sender_id)
 }
 
-func (t *SimpleChaincode) get_customers_by_sender_id(stub *shim.ChaincodeStub, sender_id string) ([]byte, error) {
+// access_keys returns the customer log key of the access record and the entity log key pointing to it.
+func access_keys(access AccessRecord) (customer_key string, entity_key string) {
+	accessed_at := fmt.Sprintf("%020d", access.AccessedAt)
+	customer_key = make_key("ACCESS", "C", access.CustomerId, accessed_at, access.TxId)
+	entity_key = make_key("ACCESS", "E", access.AccessorId, accessed_at, access.TxId)
+	return
+}
 
-	var entries CustomerData_Holder
-	var ent CustomerData
+// get_consent_record returns the Consent for the customer/receiver/sender, or nil if none was ever granted.
+func get_consent_record(stub StubInterface, customer_id string, receiver_id string, sender_id string) (*Consent, error) {
 
-	keysIter, err := stub.RangeQueryState("SCR/"+sender_id+"/", "SCR/"+sender_id+"/~")
-	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
+	bytes, err := stub.GetState(consent_key(customer_id, receiver_id, sender_id))
+	if err != nil { return nil, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return nil, nil
 	}
 
-	defer keysIter.Close()
+	var consent Consent
+	err = json.Unmarshal(bytes, &consent)
+	if err != nil { return nil, new_error(ERR_INTERNAL, "Corrupt Consent record", err.Error(), string(bytes)) }
 
-	for keysIter.HasNext() {
-		_, datakeyAsbytes, iterErr := keysIter.Next()
-		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
-		}
-		datakey:=string(datakeyAsbytes)
-		valAsbytes, err := stub.GetState(datakey)
-		if err != nil {
-			return nil, errors.New("Error getting customer data of "+datakey)
-		}
-		customer_id , receiver_id, sender_id := parse_key(datakey)
+	return &consent, nil
+}
 
-		ent = CustomerData{ CustomerId:customer_id , ReceiverId:receiver_id, SenderId:sender_id, Content:string(valAsbytes)}
+// consent_status returns one of "none", "revoked", "expired" or "active" for the customer/receiver/sender.
+func consent_status(stub StubInterface, customer_id string, receiver_id string, sender_id string) (string, error) {
 
-		entries.Entries = append(entries.Entries,ent)
+	consent, err := get_consent_record(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return "", err }
+	if consent == nil {
+		return "none", nil
+	}
+	if consent.RevokedAt != 0 {
+		return "revoked", nil
+	}
+	if consent.ExpiresAt == 0 {
+		return "active", nil
 	}
 
-	bytes, err := json.Marshal(entries)
-	if err != nil {
-		return nil, errors.New("Error creating CustomerData record")
+	now, err := get_tx_time(stub)
+	if err != nil { return "", err }
+	if now >= consent.ExpiresAt {
+		return "expired", nil
 	}
-	return []byte(bytes), nil
+	return "active", nil
 }
 
-func (t *SimpleChaincode) get_customers_by_receiver_id(stub *shim.ChaincodeStub, receiver_id string) ([]byte, error) {
+// data_visible returns false if the consent covering the customer/receiver/sender has been revoked or has expired.
+// Data registered before consents were recorded has no Consent and stays visible.
+func data_visible(stub StubInterface, customer_id string, receiver_id string, sender_id string) (bool, error) {
 
-	var entries CustomerData_Holder
-	var ent CustomerData
+	status, err := consent_status(stub, customer_id, receiver_id, sender_id)
+	if err != nil { return false, err }
 
-	keysIter, err := stub.RangeQueryState("D/"+receiver_id+"/", "D/"+receiver_id+"/~")
-	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
-	}
+	return status != "revoked" && status != "expired", nil
+}
 
-	defer keysIter.Close()
+// get_customers_in_range returns a page of the customer data under prefix, leaving out data whose consent has been
+// revoked or has expired. prefix is either a range of D/ data keys, or a range of index keys whose values point to them.
+// With content_until, for get_customer_content, Content is returned for data registered up to that time.
+func get_customers_in_range(stub StubInterface, prefix string, page Page, content_until int64) ([]byte, error) {
 
-	for keysIter.HasNext() {
-		datakeyAsbytes, dataAsBytes, iterErr := keysIter.Next()
-		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
+	entries := CustomerData_Holder{ Entries:[]CustomerData{} }
+	var err error
+
+	entries.Next, err = range_page(stub, prefix, page, func(key string, val []byte) error {
+
+		datakey := key
+		if key_type, _ := split_key(prefix); key_type != "D" {
+			datakey = string(val)
+			var err error
+			val, err = stub.GetState(datakey)
+			if err != nil {
+				return new_error(ERR_STORAGE, "Error getting customer data", datakey)
+			}
+			// an orphan index key, left for verify_indexes to report
+			if len(val) == 0 {
+				return nil
+			}
 		}
-		datakey:=string(datakeyAsbytes)
 
 		customer_id , receiver_id, sender_id := parse_key(datakey)
 		if customer_id == ""||receiver_id==""|| sender_id=="" {
-			return nil, fmt.Errorf("parse_key operation failed: %s %s %s %s",datakey, customer_id , receiver_id , sender_id)
+			return new_error(ERR_INTERNAL, "parse_key operation failed", fmt.Sprintf("%s %s %s %s",datakey, customer_id , receiver_id , sender_id))
 		}
 
-		ent = CustomerData{ CustomerId: customer_id , SenderId:sender_id, ReceiverId:receiver_id,  Content:string(dataAsBytes)}
+		visible, err := data_visible(stub, customer_id, receiver_id, sender_id)
+		if err != nil || !visible { return err }
 
-		entries.Entries = append(entries.Entries,ent)
-	}
+		version := read_data_version(val)
+
+		entry := CustomerData{ CustomerId:customer_id , ReceiverId:receiver_id, SenderId:sender_id, Version:version.Version, RegisteredAt:version.Timestamp, TxId:version.TxId, KeyId:version_key_id(version) }
+		if content_until > 0 && version.Timestamp <= content_until {
+			entry.Opaque, entry.Content = version.Opaque, version.Content
+		}
+		entries.Entries = append(entries.Entries, entry)
+		return nil
+	})
+	if err != nil { return nil, err }
 
 	bytes, err := json.Marshal(entries)
 	if err != nil {
-		return nil, errors.New("Error creating CustomerData record")
+		return nil, new_error(ERR_INTERNAL, "Error creating CustomerData record")
 	}
-	return []byte(bytes), nil
-
+	return bytes, nil
 }
 
-func (t *SimpleChaincode) get_all(stub *shim.ChaincodeStub) ([]byte, error) {
+// range_page calls fn for each key and value under prefix, a partial composite key, in key order. With a page.Limit,
+// it reads one page of that many keys starting at page.Token and returns the token of the next page, or "" when the
+// range is exhausted. Tokens are the state database's bookmarks, passed through as they are: CouchDB's are opaque.
+// Keys fn leaves out still count against the limit, so a page may be short while more follow.
+func range_page(stub StubInterface, prefix string, page Page, fn func(key string, val []byte) error) (string, error) {
 
-	result := "["
+	object_type, attributes := split_key(prefix)
+
+	var keysIter StateIterator
+	var bookmark string
+	var err error
 
-	keysIter, err := stub.RangeQueryState("", "~")
+	if page.Limit > 0 {
+		keysIter, bookmark, err = stub.GetStateByPartialCompositeKeyWithPagination(object_type, attributes, int32(page.Limit), page.Token)
+	} else {
+		if len(page.Token) > 0 {
+			return "", new_error(ERR_VALIDATION, "A continuation token needs a limit")
+		}
+		keysIter, err = stub.GetStateByPartialCompositeKey(object_type, attributes)
+	}
 	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
+		return "", new_error(ERR_STORAGE, "Unable to start the iterator")
 	}
 
 	defer keysIter.Close()
@@ -621,150 +3509,178 @@ func (t *SimpleChaincode) get_all(stub *shim.ChaincodeStub) ([]byte, error) {
 	for keysIter.HasNext() {
 		key, val, iterErr := keysIter.Next()
 		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
+			return "", new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
 		}
-		result += " [ " + key + " , " + string(val) + " ] ,"
-
-	}
 
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result) - 1] + "]"
+		err = fn(key, val)
+		if err != nil { return "", err }
 	}
 
-	return []byte(result), nil
+	return bookmark, nil
 }
 
-func (t *SimpleChaincode) get_customer_crossref(stub *shim.ChaincodeStub, entity_id string, customer_ref string) ([]byte, error) {
+// parse_page reads the optional limit and token arguments of a list query.
+func parse_page(args []string) (Page, error) {
 
-	var jsonResp = ""
-	key:="CUSTREF/"+entity_id+"/"+customer_ref
-	datakeyAsbytes, err := stub.GetState(key)
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+	var page Page
+	if len(args) > 0 && len(args[0]) > 0 {
+		// the peer takes the page size as an int32
+		limit, err := strconv.ParseInt(args[0], 10, 32)
+		if err != nil || limit < 0 {
+			return page, new_error(ERR_VALIDATION, "Invalid limit", args[0])
+		}
+		page.Limit = int(limit)
 	}
-	datakey:=string(datakeyAsbytes)
-	valAsbytes, err := stub.GetState(datakey)
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + datakey + "\"}"
-		return nil, errors.New(jsonResp)
+	if len(args) > 1 {
+		page.Token = args[1]
 	}
-
-	return []byte(valAsbytes), nil
+	return page, nil
 }
 
-func (t *SimpleChaincode) get_customer_id_by_crossref(stub *shim.ChaincodeStub, entity_id string, customer_ref string) ([]byte, error) {
+// customer_related returns true if entity_id is the sender or receiver of any consent given by the customer.
+func customer_related(stub StubInterface, customer_id string, entity_id string) (bool, error) {
 
-	var jsonResp = ""
-	key:="CUSTREF/"+entity_id+"/"+customer_ref
-	datakeyAsbytes, err := stub.GetState(key)
+	keysIter, err := stub.GetStateByPartialCompositeKey("CONSENT", []string{customer_id})
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return false, new_error(ERR_STORAGE, "Unable to start the iterator")
 	}
-	datakey:=string(datakeyAsbytes)
-	customer_id:=strings.Split( datakey,"/")[1]
 
-	return []byte(customer_id), nil
+	defer keysIter.Close()
+
+	for keysIter.HasNext() {
+		key, _, iterErr := keysIter.Next()
+		if iterErr != nil {
+			return false, new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
+		}
+		_, ids := split_key(key)
+		if len(ids) == 3 && (ids[1] == entity_id || ids[2] == entity_id) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (t *SimpleChaincode) get_all_entities(stub *shim.ChaincodeStub) ([]byte, error) {
+// delete_customer_data removes the data shared from sender_id to receiver_id for the customer,
+// together with the five index keys written by register_customer and every earlier version.
+func delete_customer_data(stub StubInterface, customer_id string, receiver_id string, sender_id string) error {
 
-	var entities Entity_Holder
-	var ent Entity
+	data_key, scr_key, src_key, rsc_key, csr_key, crs_key := create_keys(customer_id, receiver_id, sender_id)
+	keys := []string{data_key, scr_key, src_key, rsc_key, csr_key, crs_key}
 
-	keysIter, err := stub.RangeQueryState("ENTID/", "ENTID/~")
+	data, err := stub.GetState(data_key)
+	if err != nil { return new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if key_id := version_key_id(read_data_version(data)); len(data) > 0 && len(key_id) > 0 {
+		keys = append(keys, key_id_key(receiver_id, key_id, sender_id, customer_id))
+	}
+
+	for _, key := range keys {
+		err := stub.DelState(key)
+		if err != nil {
+			return new_error(ERR_STORAGE, "Unable to delete the state")
+		}
+	}
+	if len(data) > 0 {
+		emit(stub, events.Event{ Type:events.DataDeleted, CustomerId:customer_id, SenderId:sender_id, ReceiverId:receiver_id })
+	}
+
+	// earlier versions go with the data
+	keysIter, err := stub.GetStateByPartialCompositeKey("DH", []string{receiver_id, customer_id, sender_id})
 	if err != nil {
-		return nil, errors.New("Unable to start the iterator")
+		return new_error(ERR_STORAGE, "Unable to start the iterator")
 	}
 
 	defer keysIter.Close()
 
 	for keysIter.HasNext() {
-		_, val, iterErr := keysIter.Next()
+		key, _, iterErr := keysIter.Next()
 		if iterErr != nil {
-			return nil, fmt.Errorf("keys operation failed. Error accessing state: %s", err)
+			return new_error(ERR_STORAGE, "keys operation failed. Error accessing state", iterErr.Error())
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return new_error(ERR_STORAGE, "Unable to delete the state")
 		}
-		err = json.Unmarshal(val,&ent)
-		if err != nil { return nil, errors.New("Error creating Entity record") }
-		entities.Entities = append(entities.Entities,ent)
 	}
+	return nil
+}
 
-	bytes, err := json.Marshal(entities)
+// get_tx_time returns the transaction timestamp in unix seconds. Use this instead of the wall clock
+// so that every peer comes to the same result.
+func get_tx_time(stub StubInterface) (int64, error) {
+	now, err := stub.GetTxTime()
 	if err != nil {
-		return nil, errors.New("Error creating Entities record")
+		return 0, new_error(ERR_INTERNAL, "Unable to get the transaction timestamp", err.Error())
 	}
-	return []byte(bytes), nil
+	return now, nil
 }
 
-
-//=================================================================================================================================
-//	 Utility functions
-//=================================================================================================================================
-func create_keys(customer_id string, receiver_id string, sender_id string) (data_key, scr_key, src_key, rsc_key, csr_key, crs_key string) {
-	data_key = "D/" + receiver_id + "/" + customer_id + "/" + sender_id
-	scr_key = "SCR/" + sender_id + "/" + customer_id + "/" + receiver_id
-	src_key = "SRC/" + sender_id + "/" + receiver_id + "/" + customer_id
-	rsc_key = "RSC/" + receiver_id + "/" + sender_id + "/" + customer_id
-	csr_key = "CSR/" + customer_id + "/" + sender_id + "/" + receiver_id
-	crs_key = "CRS/" + customer_id + "/" + receiver_id + "/" + sender_id
-	return
+// convert_legacy_key returns the composite key for a "/" separated legacy key, and whether the value of the key is itself
+// a legacy key. It returns "" if the key is not one this chaincode wrote, or has more parts than its object type has IDs
+// because an ID contained "/".
+func convert_legacy_key(key string) (string, bool) {
+	str := strings.Split(key, "/")
+	ids, ok := legacy_key_ids[str[0]]
+	if !ok || len(str) != ids + 1 {
+		return "", false
+	}
+	for _, id := range str[1:] {
+		if len(id) == 0 || !utf8.ValidString(id) || strings.ContainsAny(id, KEY_SEPARATOR + KEY_MAX) {
+			return "", false
+		}
+	}
+	// the entity access log points to the customer access log
+	pointer := legacy_pointer_types[str[0]] || (str[0] == "ACCESS" && str[1] == "E")
+	return make_key(str[0], str[1:]...), pointer
 }
 
-func get_key(key_type string, customer_id string, receiver_id string, sender_id string) (string) {
+// check_ids returns an error unless every id matches the ID grammar of the CONFIG record. Whatever the grammar,
+// an ID has to be valid UTF-8 without the composite key separator or KEY_MAX, so that keys split back into their IDs
+// and range queries over a partial key never reach past it.
+func check_ids(stub StubInterface, ids ...string) error {
 
-	switch key_type {
-	case "data_key" :
-		return "D/" + receiver_id + "/" + customer_id + "/" + sender_id
-	case "scr_key" :
-		return "SCR/" + sender_id + "/" + customer_id + "/" + receiver_id
-	case "src_key" :
-		return "SRC/" + sender_id + "/" + receiver_id + "/" + customer_id
-	case "rsc_key" :
-		return "RSC/" + receiver_id + "/" + sender_id + "/" + customer_id
-	case "csr_key" :
-		return "CSR/" + customer_id + "/" + sender_id + "/" + receiver_id
-	case "crs_key" :
-		return "CRS/" + customer_id + "/" + receiver_id + "/" + sender_id
-	}
-	return ""
-}
+	config, err := get_config(stub)
+	if err != nil { return err }
 
-func convert_key(key_type string, current_key string) (string) {
+	pattern, err := compile_id_pattern(config.IdPattern)
+	if err != nil { return err }
 
-	customer_id, receiver_id, sender_id := parse_key(current_key)
-	return get_key(key_type, customer_id, receiver_id, sender_id)
+	for _, id := range ids {
+		if !valid_id(pattern, id) {
+			return new_error(ERR_VALIDATION, "Invalid ID", strconv.Quote(id))
+		}
+	}
+	return nil
+}
 
+// valid_id tells whether id matches pattern and can be used in a composite key.
+func valid_id(pattern *regexp.Regexp, id string) bool {
+	return utf8.ValidString(id) && !strings.ContainsAny(id, KEY_SEPARATOR + KEY_MAX) && pattern.MatchString(id)
 }
 
-func parse_key(key string) (customer_id string, receiver_id string, sender_id string) {
-	str := strings.Split( key,"/")
-	if len(str) != 4 {
-		return "", "", ""
+// compile_id_pattern anchors pattern so that it has to match an ID as a whole.
+func compile_id_pattern(pattern string) (*regexp.Regexp, error) {
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, new_error(ERR_VALIDATION, "Invalid ID pattern", err.Error())
 	}
+	return compiled, nil
+}
 
-	switch str[0] {
-	case "D" :
-		receiver_id = str[1]; customer_id = str[2]; sender_id = str[3]
-	case "SCR" :
-		sender_id = str[1]; customer_id = str[2]; receiver_id = str[3]
-	case "SRC" :
-		sender_id = str[1]; receiver_id = str[2]; customer_id = str[3]
-	case "RSC" :
-		receiver_id = str[1]; sender_id = str[2]; customer_id = str[3]
-	case "CSR" :
-		customer_id = str[1]; sender_id = str[2]; receiver_id = str[3]
-	case "CRS" :
-		customer_id = str[1]; receiver_id = str[2]; sender_id = str[3]
+// get_config returns the CONFIG record, or the defaults if Init has not stored one.
+func get_config(stub StubInterface) (Config, error) {
+
+	config := Config{ IdPattern:DEFAULT_ID_PATTERN }
+
+	bytes, err := stub.GetState(make_key("CONFIG"))
+	if err != nil { return config, new_error(ERR_STORAGE, "Error in GetState", err.Error()) }
+	if len(bytes) == 0 {
+		return config, nil
 	}
-	return customer_id , receiver_id , sender_id
-}
 
-func valid_key(key string)(bool){
-	match, _ :=  regexp.MatchString("\\w", key)
-	return match
+	err = json.Unmarshal(bytes, &config)
+	if err != nil { return config, new_error(ERR_INTERNAL, "Corrupt Config record", err.Error(), string(bytes)) }
+
+	return config, nil
 }
 
 
@@ -0,0 +1,1755 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kkoiwai/ConsentForm/envelope"
+	"github.com/kkoiwai/ConsentForm/events"
+)
+
+//==============================================================================================================================
+//	 MemStub - An in-memory StubInterface. Like the peer, reads only see the committed state: writes are buffered until
+//			   the transaction is committed, and range queries iterate over a snapshot of the range taken when the query
+//			   starts.
+//==============================================================================================================================
+type MemStub struct {
+	State  map[string][]byte
+	Caller string
+	TxId   string
+	TxTime int64
+	// the chaincode event of the transaction; like the peer, SetEvent replaces it
+	EventName    string
+	EventPayload []byte
+	// the writes of the transaction, a nil value for a deleted key
+	writes map[string][]byte
+}
+
+func new_mem_stub() *MemStub {
+	return &MemStub{State: map[string][]byte{}, TxId: "tx0", TxTime: 1000, writes: map[string][]byte{}}
+}
+
+// commit applies the writes of the transaction to the state.
+func (s *MemStub) commit() {
+	for key, value := range s.writes {
+		if value == nil {
+			delete(s.State, key)
+		} else {
+			s.State[key] = value
+		}
+	}
+	s.writes = map[string][]byte{}
+}
+
+// rollback drops the writes and the event of the transaction, as the peer does for a failed or evaluated one.
+func (s *MemStub) rollback() {
+	s.writes = map[string][]byte{}
+	s.EventName, s.EventPayload = "", nil
+}
+
+func (s *MemStub) GetState(key string) ([]byte, error) {
+	return s.State[key], nil
+}
+
+func (s *MemStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	s.writes[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *MemStub) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+// GetStateByRange returns the simple keys in the range, like the peer; "" leaves either end open.
+func (s *MemStub) GetStateByRange(startKey string, endKey string) (StateIterator, error) {
+	var keys []string
+	for key := range s.State {
+		if !strings.HasPrefix(key, KEY_SEPARATOR) && key >= startKey && (endKey == "" || key < endKey) {
+			keys = append(keys, key)
+		}
+	}
+	return s.snapshot(keys), nil
+}
+
+func (s *MemStub) GetStateByPartialCompositeKey(objectType string, keys []string) (StateIterator, error) {
+	return s.snapshot(s.sorted(make_key(objectType, keys...))), nil
+}
+
+// GetStateByPartialCompositeKeyWithPagination starts at bookmark, the first key of the page, and returns the first key
+// of the next page as the next bookmark.
+func (s *MemStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (StateIterator, string, error) {
+	var page []string
+	for _, key := range s.sorted(make_key(objectType, keys...)) {
+		if key < bookmark {
+			continue
+		}
+		if len(page) == int(pageSize) {
+			return s.snapshot(page), key, nil
+		}
+		page = append(page, key)
+	}
+	return s.snapshot(page), "", nil
+}
+
+func (s *MemStub) GetTxID() string {
+	return s.TxId
+}
+
+func (s *MemStub) GetTxTime() (int64, error) {
+	return s.TxTime, nil
+}
+
+func (s *MemStub) GetAttributeValue(attrName string) (string, bool, error) {
+	if attrName != "entity_id" || s.Caller == "" {
+		return "", false, nil
+	}
+	return s.Caller, true, nil
+}
+
+// SetEvent keeps the last event set, like the peer does for a transaction.
+func (s *MemStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("empty event name")
+	}
+	s.EventName = name
+	s.EventPayload = append([]byte(nil), payload...)
+	return nil
+}
+
+// snapshot returns an iterator over the current values of keys, in key order.
+func (s *MemStub) snapshot(keys []string) *mem_iterator {
+	sort.Strings(keys)
+	iter := &mem_iterator{keys: keys}
+	for _, key := range keys {
+		iter.values = append(iter.values, s.State[key])
+	}
+	return iter
+}
+
+// sorted returns the keys in the state starting with prefix.
+func (s *MemStub) sorted(prefix string) []string {
+	var keys []string
+	for key := range s.State {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type mem_iterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+func (i *mem_iterator) HasNext() bool {
+	return i.pos < len(i.keys)
+}
+
+func (i *mem_iterator) Next() (string, []byte, error) {
+	if !i.HasNext() {
+		return "", nil, errors.New("iterator exhausted")
+	}
+	i.pos++
+	return i.keys[i.pos-1], i.values[i.pos-1], nil
+}
+
+func (i *mem_iterator) Close() error {
+	return nil
+}
+
+//==============================================================================================================================
+//	 Test environment - bank1, bank2, bank4 and reg1 hold ECDSA P-256 keys, bank3 an RSA key. Keys are generated once per
+//						test run.
+//==============================================================================================================================
+var test_keys map[string]crypto.Signer
+
+func entity_keys(t *testing.T) map[string]crypto.Signer {
+	if test_keys != nil {
+		return test_keys
+	}
+	test_keys = map[string]crypto.Signer{}
+	for _, entity_id := range []string{"bank1", "bank2", "bank4", "cm1", "reg1"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test_keys[entity_id] = key
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_keys["bank3"] = key
+	return test_keys
+}
+
+type test_env struct {
+	t    *testing.T
+	cc   *SimpleChaincode
+	stub *MemStub
+	keys map[string]crypto.Signer
+	tx   int
+}
+
+// new_empty_env returns an environment for a ledger instantiated with admin as its initial admin.
+func new_empty_env(t *testing.T, admin string) *test_env {
+	e := &test_env{t: t, cc: new(SimpleChaincode), stub: new_mem_stub(), keys: entity_keys(t)}
+	if _, err := e.init("", admin); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// new_test_env registers bank1 as the first entity, which makes it an admin, then has it register bank2, bank3,
+// the regulator reg1 and the consent manager cm1. It shares customer c1's data from bank1 to bank2 and registers
+// bank1's crossref ref1 for c1.
+func new_test_env(t *testing.T) *test_env {
+	e := new_empty_env(t, "bank1")
+	for _, entity_id := range []string{"bank1", "bank2", "bank3"} {
+		e.must_invoke("bank1", "register_entity", entity_id, "Bank "+entity_id, e.public_key(entity_id))
+	}
+	e.must_invoke("bank1", "register_entity", "reg1", "Regulator", e.public_key("reg1"), ROLE_REGULATOR)
+	e.must_invoke("bank1", "register_entity", "cm1", "Consent Manager", e.public_key("cm1"), ROLE_CONSENT_MANAGER)
+	e.share("c1", "bank2", "bank1", `{"name":"Alice"}`)
+	e.must_invoke("bank1", "register_customer_crossref", "c1", "bank1", "ref1")
+	return e
+}
+
+// init runs Init in a transaction of its own, committed if it succeeds.
+func (e *test_env) init(args ...string) ([]byte, error) {
+	return e.submit(func() ([]byte, error) {
+		return e.cc.init(e.stub, "init", args)
+	})
+}
+
+func (e *test_env) invoke(caller string, function string, args ...string) ([]byte, error) {
+	e.stub.Caller = caller
+	return e.submit(func() ([]byte, error) {
+		return e.cc.invoke(e.stub, function, args)
+	})
+}
+
+// query evaluates function: whatever it writes is dropped, as the peer does.
+func (e *test_env) query(caller string, function string, args ...string) ([]byte, error) {
+	e.stub.Caller = caller
+	defer e.stub.rollback()
+	return e.cc.query(e.stub, function, args)
+}
+
+// submit runs fn as the next transaction, committing its writes if it succeeds and dropping them if it fails.
+func (e *test_env) submit(fn func() ([]byte, error)) ([]byte, error) {
+	e.tx++
+	e.stub.TxId = fmt.Sprintf("tx%d", e.tx)
+	e.stub.EventName, e.stub.EventPayload = "", nil
+	result, err := fn()
+	if err != nil {
+		e.stub.rollback()
+		return nil, err
+	}
+	e.stub.commit()
+	return result, nil
+}
+
+func (e *test_env) must_invoke(caller string, function string, args ...string) []byte {
+	e.t.Helper()
+	result, err := e.invoke(caller, function, args...)
+	if err != nil {
+		e.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return result
+}
+
+func (e *test_env) must_query(caller string, function string, args ...string) []byte {
+	e.t.Helper()
+	result, err := e.query(caller, function, args...)
+	if err != nil {
+		e.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return result
+}
+
+func (e *test_env) public_key(entity_id string) string {
+	der, err := x509.MarshalPKIXPublicKey(e.keys[entity_id].Public())
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// sign returns entity_id's signature over the canonical arguments of function.
+func (e *test_env) sign(entity_id string, function string, args ...string) string {
+	digest := sha256.Sum256(canonical_args(function, args...))
+	var opts crypto.SignerOpts = crypto.SHA256
+	sig, err := e.keys[entity_id].Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// seal encrypts plaintext for receiver_id's current key.
+func (e *test_env) seal(receiver_id string, plaintext string) string {
+	env, err := envelope.Encrypt(e.public_key(receiver_id), []byte(plaintext))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	bytes, _ := json.Marshal(env)
+	return string(bytes)
+}
+
+// register_args returns the signed arguments of register_customer.
+func (e *test_env) register_args(customer_id string, receiver_id string, sender_id string, plaintext string) []string {
+	json_data := e.seal(receiver_id, plaintext)
+	return []string{customer_id, receiver_id, sender_id, json_data, e.sign(sender_id, "register_customer", customer_id, receiver_id, sender_id, json_data)}
+}
+
+// batch_args returns the signed arguments of register_customers_batch for entries sent by sender_id.
+func (e *test_env) batch_args(sender_id string, entries ...CustomerBatchEntry) []string {
+	for i := range entries {
+		entries[i].SenderId = sender_id
+		entries[i].Content = json.RawMessage(e.seal(entries[i].ReceiverId, `{"name":"`+entries[i].CustomerId+`"}`))
+	}
+	batch, _ := json.Marshal(entries)
+	return []string{string(batch), e.sign(sender_id, "register_customers_batch", string(batch))}
+}
+
+// share has the consent manager cm1 grant consent, then registers the customer's data from sender_id to receiver_id.
+func (e *test_env) share(customer_id string, receiver_id string, sender_id string, plaintext string) {
+	e.t.Helper()
+	e.must_invoke("cm1", "grant_consent", customer_id, receiver_id, sender_id, "account opening", "kyc", "")
+	e.must_invoke(sender_id, "register_customer", e.register_args(customer_id, receiver_id, sender_id, plaintext)...)
+}
+
+// access has receiver_id record an access to the customer's data, then reads the data under that record.
+func (e *test_env) access(customer_id string, receiver_id string, purpose string) CustomerData_Holder {
+	e.t.Helper()
+	var access AccessRecord
+	if err := json.Unmarshal(e.must_invoke(receiver_id, "access_customer", customer_id, receiver_id, purpose), &access); err != nil {
+		e.t.Fatal(err)
+	}
+	return decode_customers(e.t, e.must_query(receiver_id, "get_customer_content", customer_id, receiver_id, access.TxId))
+}
+
+// snapshot_state returns the whole ledger as one string, to tell whether a transaction wrote anything.
+func (e *test_env) snapshot_state() string {
+	var keys []string
+	for key := range e.stub.State {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var state strings.Builder
+	for _, key := range keys {
+		state.WriteString(key + "=" + string(e.stub.State[key]) + "\n")
+	}
+	return state.String()
+}
+
+func error_code(err error) string {
+	var cc_err *ChaincodeError
+	if errors.As(err, &cc_err) {
+		return cc_err.Code
+	}
+	if err != nil {
+		return "untyped: " + err.Error()
+	}
+	return ""
+}
+
+func decode_customers(t *testing.T, bytes []byte) CustomerData_Holder {
+	t.Helper()
+	var holder CustomerData_Holder
+	if err := json.Unmarshal(bytes, &holder); err != nil {
+		t.Fatalf("%v: %s", err, bytes)
+	}
+	return holder
+}
+
+//==============================================================================================================================
+//	 Invoke functions
+//==============================================================================================================================
+func TestInvoke(t *testing.T) {
+
+	form_schema := `{"type":"object","properties":{"name":{"type":"string"},"email":{"type":"string"}},"required":["name"],"additionalProperties":false}`
+
+	cases := []struct {
+		name     string
+		caller   string
+		function string
+		args     func(e *test_env) []string
+		code     string
+	}{
+		{"register_customer", "bank1", "register_customer", func(e *test_env) []string {
+			return e.register_args("c1", "bank2", "bank1", `{"name":"Alice Smith"}`)
+		}, ""},
+		{"register_customers_batch", "bank1", "register_customers_batch", func(e *test_env) []string {
+			return e.batch_args("bank1", CustomerBatchEntry{CustomerId: "c1", ReceiverId: "bank2"})
+		}, ""},
+		{"register_customers_batch empty", "bank1", "register_customers_batch", func(e *test_env) []string {
+			return []string{"[]", e.sign("bank1", "register_customers_batch", "[]")}
+		}, ERR_VALIDATION},
+		{"register_customers_batch signed by another entity", "bank1", "register_customers_batch", func(e *test_env) []string {
+			args := e.batch_args("bank1", CustomerBatchEntry{CustomerId: "c1", ReceiverId: "bank2"})
+			return []string{args[0], e.sign("bank2", "register_customers_batch", args[0])}
+		}, ERR_UNAUTHORIZED},
+		{"register_customers_batch for another sender", "bank2", "register_customers_batch", func(e *test_env) []string {
+			args := e.batch_args("bank1", CustomerBatchEntry{CustomerId: "c1", ReceiverId: "bank2"})
+			return []string{args[0], e.sign("bank2", "register_customers_batch", args[0])}
+		}, ERR_UNAUTHORIZED},
+		{"register_customer to RSA receiver", "bank1", "register_customer", func(e *test_env) []string {
+			e.must_invoke("cm1", "grant_consent", "c1", "bank3", "bank1", "loan", "kyc", "")
+			return e.register_args("c1", "bank3", "bank1", `{"name":"Alice"}`)
+		}, ""},
+		{"register_customer by RSA sender", "bank3", "register_customer", func(e *test_env) []string {
+			e.must_invoke("cm1", "grant_consent", "c1", "bank2", "bank3", "loan", "kyc", "")
+			return e.register_args("c1", "bank2", "bank3", `{"name":"Alice"}`)
+		}, ""},
+		{"register_customer without consent", "bank1", "register_customer", func(e *test_env) []string {
+			return e.register_args("c2", "bank2", "bank1", `{"name":"Bob"}`)
+		}, ERR_UNAUTHORIZED},
+		{"register_customer for another sender", "bank2", "register_customer", func(e *test_env) []string {
+			return e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)
+		}, ERR_UNAUTHORIZED},
+		{"register_customer with bad signature", "bank1", "register_customer", func(e *test_env) []string {
+			args := e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)
+			args[4] = e.sign("bank1", "register_customer", "c1", "bank2", "bank1", "tampered")
+			return args
+		}, ERR_UNAUTHORIZED},
+		{"register_customer unsigned", "bank1", "register_customer", func(e *test_env) []string {
+			args := e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)
+			args[4] = ""
+			return args
+		}, ERR_UNAUTHORIZED},
+		{"register_customer with plaintext content", "bank1", "register_customer", func(e *test_env) []string {
+			json_data := `{"name":"Alice"}`
+			return []string{"c1", "bank2", "bank1", json_data, e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data)}
+		}, ERR_VALIDATION},
+		{"register_customer encrypted for another entity", "bank1", "register_customer", func(e *test_env) []string {
+			json_data := e.seal("bank3", `{"name":"Alice"}`)
+			return []string{"c1", "bank2", "bank1", json_data, e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data)}
+		}, ERR_VALIDATION},
+		{"register_customer with form template", "bank1", "register_customer", func(e *test_env) []string {
+			e.must_invoke("bank1", "register_form_template", "kyc", "1", "en", form_schema)
+			json_data := e.seal("bank2", `{"name":"Alice","email":"alice@example.com"}`)
+			return []string{"c1", "bank2", "bank1", json_data, "kyc", "1", e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data, "kyc", "1")}
+		}, ""},
+		{"register_customer collecting more than the form", "bank1", "register_customer", func(e *test_env) []string {
+			e.must_invoke("bank1", "register_form_template", "kyc", "1", "en", form_schema)
+			json_data := e.seal("bank2", `{"name":"Alice","income":100}`)
+			return []string{"c1", "bank2", "bank1", json_data, "kyc", "1", e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data, "kyc", "1")}
+		}, ERR_VALIDATION},
+		{"register_customer missing a required field", "bank1", "register_customer", func(e *test_env) []string {
+			e.must_invoke("bank1", "register_form_template", "kyc", "1", "en", form_schema)
+			json_data := e.seal("bank2", `{"email":"alice@example.com"}`)
+			return []string{"c1", "bank2", "bank1", json_data, "kyc", "1", e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data, "kyc", "1")}
+		}, ERR_VALIDATION},
+		{"register_customer with unknown form template", "bank1", "register_customer", func(e *test_env) []string {
+			json_data := e.seal("bank2", `{"name":"Alice"}`)
+			return []string{"c1", "bank2", "bank1", json_data, "kyc", "9", e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data, "kyc", "9")}
+		}, ERR_NOT_FOUND},
+		{"register_customer with an invalid form template ID", "bank1", "register_customer", func(e *test_env) []string {
+			json_data := e.seal("bank2", `{"name":"Alice"}`)
+			return []string{"c1", "bank2", "bank1", json_data, "kyc\x00", "1", e.sign("bank1", "register_customer", "c1", "bank2", "bank1", json_data, "kyc\x00", "1")}
+		}, ERR_VALIDATION},
+		{"register_customer wrong argument count", "bank1", "register_customer", func(e *test_env) []string {
+			return []string{"c1", "bank2", "bank1"}
+		}, ERR_VALIDATION},
+
+		{"delete_customer", "bank1", "delete_customer", func(e *test_env) []string {
+			return []string{"c1", "bank1", e.sign("bank1", "delete_customer", "c1", "bank1")}
+		}, ""},
+		{"delete_customer for another sender", "bank2", "delete_customer", func(e *test_env) []string {
+			return []string{"c1", "bank1", e.sign("bank2", "delete_customer", "c1", "bank1")}
+		}, ERR_UNAUTHORIZED},
+		{"delete_customer signed by another entity", "bank1", "delete_customer", func(e *test_env) []string {
+			return []string{"c1", "bank1", e.sign("bank2", "delete_customer", "c1", "bank1")}
+		}, ERR_UNAUTHORIZED},
+
+		{"erase_customer", "cm1", "erase_customer", func(e *test_env) []string {
+			return []string{"c1", e.sign("cm1", "erase_customer", "c1")}
+		}, ""},
+		{"erase_customer by a regulator", "reg1", "erase_customer", func(e *test_env) []string {
+			return []string{"c1", e.sign("reg1", "erase_customer", "c1")}
+		}, ""},
+		{"erase_customer by a receiver", "bank2", "erase_customer", func(e *test_env) []string {
+			return []string{"c1", e.sign("bank2", "erase_customer", "c1")}
+		}, ERR_UNAUTHORIZED},
+		{"erase_customer by a crossref holder", "bank1", "erase_customer", func(e *test_env) []string {
+			return []string{"c1", e.sign("bank1", "erase_customer", "c1")}
+		}, ERR_UNAUTHORIZED},
+		{"erase_customer signed by another entity", "cm1", "erase_customer", func(e *test_env) []string {
+			return []string{"c1", e.sign("reg1", "erase_customer", "c1")}
+		}, ERR_UNAUTHORIZED},
+
+		{"register_customer_crossref", "bank2", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c1", "bank2", "ref9"}
+		}, ""},
+		{"register_customer_crossref duplicate", "bank1", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c1", "bank1", "ref1"}
+		}, ERR_DUPLICATE},
+		{"register_customer_crossref duplicate ref for another customer", "bank1", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c2", "bank1", "ref1"}
+		}, ERR_DUPLICATE},
+		{"register_customer_crossref with a separator in the ref", "bank1", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c1", "bank1", "ref/2"}
+		}, ERR_VALIDATION},
+		{"register_customer_crossref with a NUL in the ref", "bank1", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c1", "bank1", "ref\x002"}
+		}, ERR_VALIDATION},
+		{"register_customer_crossref for another entity", "bank2", "register_customer_crossref", func(e *test_env) []string {
+			return []string{"c1", "bank1", "ref2"}
+		}, ERR_UNAUTHORIZED},
+
+		{"delete_customer_crossref", "bank1", "delete_customer_crossref", func(e *test_env) []string {
+			return []string{"bank1", "ref1", e.sign("bank1", "delete_customer_crossref", "bank1", "ref1")}
+		}, ""},
+		{"delete_customer_crossref unknown", "bank1", "delete_customer_crossref", func(e *test_env) []string {
+			return []string{"bank1", "ref9", e.sign("bank1", "delete_customer_crossref", "bank1", "ref9")}
+		}, ERR_NOT_FOUND},
+
+		{"register_entity", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", e.public_key("bank4")}
+		}, ""},
+		{"register_entity with roles", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", e.public_key("bank4"), "consent_manager, regulator"}
+		}, ""},
+		{"register_entity with an unknown role", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", e.public_key("bank4"), "auditor"}
+		}, ERR_VALIDATION},
+		{"register_entity by a non-admin", "bank2", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", e.public_key("bank4")}
+		}, ERR_UNAUTHORIZED},
+		{"register_entity by itself", "bank4", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", e.public_key("bank4")}
+		}, ERR_UNAUTHORIZED},
+		{"register_entity with invalid key", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank4", "Bank 4", "not a key"}
+		}, ERR_VALIDATION},
+		{"register_entity changing the key of a receiver with data", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank2", "Bank 2", e.public_key("bank4")}
+		}, ERR_CONFLICT},
+		{"register_entity renaming a receiver with data", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank2", "Bank Two", e.public_key("bank2")}
+		}, ""},
+		{"register_entity dropping the caller's admin role", "bank1", "register_entity", func(e *test_env) []string {
+			return []string{"bank1", "Bank 1", e.public_key("bank1"), "data_provider"}
+		}, ERR_CONFLICT},
+
+		{"import_entities", "bank1", "import_entities", func(e *test_env) []string {
+			return []string{string(e.must_query("bank1", "export_entities"))}
+		}, ""},
+		{"import_entities by a non-admin", "bank2", "import_entities", func(e *test_env) []string {
+			return []string{string(e.must_query("bank1", "export_entities"))}
+		}, ERR_UNAUTHORIZED},
+		{"import_entities truncated", "bank1", "import_entities", func(e *test_env) []string {
+			return []string{`{"count":2,"entities":[]}`}
+		}, ERR_VALIDATION},
+		{"delete_entity", "bank1", "delete_entity", func(e *test_env) []string {
+			return []string{"bank3", e.sign("bank1", "delete_entity", "bank3")}
+		}, ""},
+		{"delete_entity unknown", "bank1", "delete_entity", func(e *test_env) []string {
+			return []string{"bank9", e.sign("bank1", "delete_entity", "bank9")}
+		}, ERR_NOT_FOUND},
+		{"delete_entity signed by the entity", "bank1", "delete_entity", func(e *test_env) []string {
+			return []string{"bank3", e.sign("bank3", "delete_entity", "bank3")}
+		}, ERR_UNAUTHORIZED},
+		{"delete_entity of a receiver with data", "bank1", "delete_entity", func(e *test_env) []string {
+			return []string{"bank2", e.sign("bank1", "delete_entity", "bank2")}
+		}, ERR_CONFLICT},
+		{"delete_entity of the caller", "bank1", "delete_entity", func(e *test_env) []string {
+			return []string{"bank1", e.sign("bank1", "delete_entity", "bank1")}
+		}, ERR_CONFLICT},
+		{"delete_entity by a non-admin", "bank3", "delete_entity", func(e *test_env) []string {
+			return []string{"bank3", e.sign("bank3", "delete_entity", "bank3")}
+		}, ERR_UNAUTHORIZED},
+
+		{"grant_consent", "cm1", "grant_consent", func(e *test_env) []string {
+			return []string{"c2", "bank3", "bank1", "marketing", "email", "2000"}
+		}, ""},
+		{"grant_consent already expired", "cm1", "grant_consent", func(e *test_env) []string {
+			return []string{"c2", "bank3", "bank1", "marketing", "email", "1000"}
+		}, ERR_VALIDATION},
+		{"grant_consent by sender", "bank1", "grant_consent", func(e *test_env) []string {
+			return []string{"c2", "bank3", "bank1", "marketing", "email", ""}
+		}, ERR_UNAUTHORIZED},
+		{"grant_consent by receiver", "bank3", "grant_consent", func(e *test_env) []string {
+			return []string{"c2", "bank3", "bank1", "marketing", "email", ""}
+		}, ERR_UNAUTHORIZED},
+
+		{"revoke_consent by sender", "bank1", "revoke_consent", func(e *test_env) []string {
+			return []string{"c1", "bank2", "bank1"}
+		}, ""},
+		{"revoke_consent by receiver", "bank2", "revoke_consent", func(e *test_env) []string {
+			return []string{"c1", "bank2", "bank1"}
+		}, ""},
+		{"revoke_consent twice", "bank1", "revoke_consent", func(e *test_env) []string {
+			e.must_invoke("bank1", "revoke_consent", "c1", "bank2", "bank1")
+			return []string{"c1", "bank2", "bank1"}
+		}, ERR_CONFLICT},
+		{"revoke_consent never granted", "bank1", "revoke_consent", func(e *test_env) []string {
+			return []string{"c2", "bank2", "bank1"}
+		}, ERR_NOT_FOUND},
+
+		{"purge_expired", "bank1", "purge_expired", func(e *test_env) []string {
+			return []string{}
+		}, ""},
+		{"purge_expired by a data provider", "bank3", "purge_expired", func(e *test_env) []string {
+			return []string{}
+		}, ERR_UNAUTHORIZED},
+		{"register_customer by a regulator", "reg1", "register_customer", func(e *test_env) []string {
+			return e.register_args("c1", "bank2", "bank1", `{"name":"Alice Smith"}`)
+		}, ERR_UNAUTHORIZED},
+
+		{"access_customer", "bank2", "access_customer", func(e *test_env) []string {
+			return []string{"c1", "bank2", "fraud check"}
+		}, ""},
+		{"access_customer without purpose", "bank2", "access_customer", func(e *test_env) []string {
+			return []string{"c1", "bank2", ""}
+		}, ERR_VALIDATION},
+		{"access_customer for another receiver", "bank3", "access_customer", func(e *test_env) []string {
+			return []string{"c1", "bank2", "fraud check"}
+		}, ERR_UNAUTHORIZED},
+
+		{"register_form_template", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", form_schema}
+		}, ""},
+		{"register_form_template duplicate", "bank1", "register_form_template", func(e *test_env) []string {
+			e.must_invoke("bank1", "register_form_template", "kyc", "1", "en", form_schema)
+			return []string{"kyc", "1", "ja", form_schema}
+		}, ERR_DUPLICATE},
+		{"register_form_template with invalid schema", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", `{"type":"string"}`}
+		}, ERR_VALIDATION},
+		{"register_form_template with annotations", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"KYC","type":"object","properties":{"name":{"type":"string","minLength":1}}}`}
+		}, ""},
+		{"register_form_template with a keyword the ledger ignores", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", `{"type":"object","properties":{"name":{"type":"string"}},"minProperties":2}`}
+		}, ERR_VALIDATION},
+		{"register_form_template with a combined schema", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", `{"type":"object","properties":{"name":{"type":"string"}},"anyOf":[{"required":["name"]}]}`}
+		}, ERR_VALIDATION},
+		{"register_form_template with an additionalProperties schema", "bank1", "register_form_template", func(e *test_env) []string {
+			return []string{"kyc", "1", "en", `{"type":"object","properties":{"name":{"type":"string"}},"additionalProperties":{"type":"string"}}`}
+		}, ERR_VALIDATION},
+
+		{"unknown function", "bank1", "no_such_function", func(e *test_env) []string {
+			return []string{}
+		}, ERR_VALIDATION},
+		{"grant_consent with an empty customer", "cm1", "grant_consent", func(e *test_env) []string {
+			return []string{"", "bank2", "bank1", "marketing", "email", ""}
+		}, ERR_VALIDATION},
+		{"grant_consent with a range delimiter in the customer", "cm1", "grant_consent", func(e *test_env) []string {
+			return []string{"c1~", "bank2", "bank1", "marketing", "email", ""}
+		}, ERR_VALIDATION},
+		{"rotate_entity_key", "bank2", "rotate_entity_key", func(e *test_env) []string {
+			return []string{"bank2", e.public_key("bank4"), e.sign("bank4", "rotate_entity_key", "bank2", e.public_key("bank4"))}
+		}, ""},
+		{"rotate_entity_key signed with the current key", "bank2", "rotate_entity_key", func(e *test_env) []string {
+			return []string{"bank2", e.public_key("bank4"), e.sign("bank2", "rotate_entity_key", "bank2", e.public_key("bank4"))}
+		}, ERR_UNAUTHORIZED},
+		{"rotate_entity_key to the current key", "bank2", "rotate_entity_key", func(e *test_env) []string {
+			return []string{"bank2", e.public_key("bank2"), e.sign("bank2", "rotate_entity_key", "bank2", e.public_key("bank2"))}
+		}, ERR_CONFLICT},
+		{"rotate_entity_key of another entity", "bank1", "rotate_entity_key", func(e *test_env) []string {
+			return []string{"bank2", e.public_key("bank4"), e.sign("bank4", "rotate_entity_key", "bank2", e.public_key("bank4"))}
+		}, ERR_UNAUTHORIZED},
+		{"migrate_keys", "bank1", "migrate_keys", func(e *test_env) []string {
+			return []string{"10"}
+		}, ""},
+		{"migrate_keys by a non-admin", "bank2", "migrate_keys", func(e *test_env) []string {
+			return []string{"10"}
+		}, ERR_UNAUTHORIZED},
+		{"unregistered caller", "bank9", "purge_expired", func(e *test_env) []string {
+			return []string{}
+		}, ERR_UNAUTHORIZED},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := new_test_env(t)
+			_, err := e.invoke(c.caller, c.function, c.args(e)...)
+			if code := error_code(err); code != c.code {
+				t.Fatalf("got error code %q (%v), want %q", code, err, c.code)
+			}
+		})
+	}
+}
+
+//==============================================================================================================================
+//	 Query functions
+//==============================================================================================================================
+func TestQuery(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		caller   string
+		function string
+		args     []string
+		code     string
+		contains string
+	}{
+		{"get_customer", "bank2", "get_customer", []string{"c1", "bank2"}, "", `"customer_id":"c1"`},
+		{"get_customer by sender", "bank1", "get_customer", []string{"c1", "bank2"}, ERR_UNAUTHORIZED, ""},
+		{"get_customer paged", "bank2", "get_customer", []string{"c1", "bank2", "1", ""}, "", `"version":1`},
+		{"get_customer_content by the sender", "bank1", "get_customer_content", []string{"c1", "bank2", "tx1"}, ERR_UNAUTHORIZED, ""},
+		{"get_customer invalid limit", "bank2", "get_customer", []string{"c1", "bank2", "x"}, ERR_VALIDATION, ""},
+		{"export_state", "reg1", "export_state", []string{}, "", `{"key":"\u0000ENTID\u0000bank1\u0000","type":"ENTID","value":{"entity_id":"bank1"`},
+		{"export_state by an admin", "bank1", "export_state", []string{"CUSTREF"}, "", `"value":"\u0000CUSTID\u0000c1\u0000","opaque":true`},
+		{"export_state by a data provider", "bank2", "export_state", []string{}, ERR_UNAUTHORIZED, ""},
+		{"export_state of an unknown object type", "reg1", "export_state", []string{"X"}, ERR_VALIDATION, ""},
+		{"export_state with a token for another object type", "reg1", "export_state", []string{"D", "1", "ENTID/"}, ERR_VALIDATION, ""},
+		{"get_customer_crossref", "bank1", "get_customer_crossref", []string{"bank1", "ref1"}, "", `"customer_ref":"ref1"`},
+		{"get_customer_crossref unknown", "bank1", "get_customer_crossref", []string{"bank1", "ref9"}, ERR_NOT_FOUND, ""},
+		{"get_customer_crossref of another entity", "bank2", "get_customer_crossref", []string{"bank1", "ref1"}, ERR_UNAUTHORIZED, ""},
+		{"get_all_entities", "reg1", "get_all_entities", []string{}, "", `"entity_id":"bank3"`},
+		{"get_all_entities by a data provider", "bank3", "get_all_entities", []string{}, ERR_UNAUTHORIZED, ""},
+		{"export_entities", "reg1", "export_entities", []string{}, "", `"count":5`},
+		{"export_entities by a data provider", "bank2", "export_entities", []string{}, ERR_UNAUTHORIZED, ""},
+		{"get_entity", "bank3", "get_entity", []string{"bank2"}, "", `"roles":["data_consumer","data_provider"]`},
+		{"get_entity unknown", "bank3", "get_entity", []string{"bank9"}, ERR_NOT_FOUND, ""},
+		{"get_customers_by_sender_id", "bank1", "get_customers_by_sender_id", []string{"bank1"}, "", `"receiver_id":"bank2"`},
+		{"get_customers_by_sender_id of another sender", "bank2", "get_customers_by_sender_id", []string{"bank1"}, ERR_UNAUTHORIZED, ""},
+		{"get_customers_by_receiver_id", "bank2", "get_customers_by_receiver_id", []string{"bank2"}, "", `"sender_id":"bank1"`},
+		{"get_customer_id_by_crossref", "bank1", "get_customer_id_by_crossref", []string{"bank1", "ref1"}, "", "c1"},
+		{"get_customer_id_by_crossref unknown", "bank1", "get_customer_id_by_crossref", []string{"bank1", "ref9"}, ERR_NOT_FOUND, ""},
+		{"get_consent", "bank2", "get_consent", []string{"c1", "bank2", "bank1"}, "", `"purpose":"account opening"`},
+		{"get_consent unknown", "bank2", "get_consent", []string{"c9", "bank2", "bank1"}, ERR_NOT_FOUND, ""},
+		{"get_consent by unrelated entity", "bank3", "get_consent", []string{"c1", "bank2", "bank1"}, ERR_UNAUTHORIZED, ""},
+		{"get_consent by a consent manager", "cm1", "get_consent", []string{"c1", "bank2", "bank1"}, "", `"purpose":"account opening"`},
+		{"get_consent by a regulator", "reg1", "get_consent", []string{"c1", "bank2", "bank1"}, "", `"purpose":"account opening"`},
+		{"get_access_log by entity", "bank2", "get_access_log", []string{"entity", "bank2"}, "", `{"entries":[]}`},
+		{"get_access_log by customer", "bank1", "get_access_log", []string{"customer", "c1"}, "", `"entries"`},
+		{"get_access_log of unrelated customer", "bank3", "get_access_log", []string{"customer", "c1"}, ERR_UNAUTHORIZED, ""},
+		{"get_access_log by a consent manager", "cm1", "get_access_log", []string{"customer", "c1"}, "", `"entries"`},
+		{"get_access_log by a regulator", "reg1", "get_access_log", []string{"entity", "bank2"}, "", `"entries"`},
+		{"get_access_log invalid type", "bank1", "get_access_log", []string{"bank", "bank1"}, ERR_VALIDATION, ""},
+		{"get_customer_sharing_map", "bank1", "get_customer_sharing_map", []string{"c1"}, "", `{"sender_id":"bank1","receiver_id":"bank2"}`},
+		{"get_customer_sharing_map by unrelated entity", "bank3", "get_customer_sharing_map", []string{"c1"}, ERR_UNAUTHORIZED, ""},
+		{"get_customer_sharing_map by a consent manager", "cm1", "get_customer_sharing_map", []string{"c1"}, "", `{"sender_id":"bank1","receiver_id":"bank2"}`},
+		{"get_customer_sharing_map by a regulator", "reg1", "get_customer_sharing_map", []string{"c1"}, "", `{"sender_id":"bank1","receiver_id":"bank2"}`},
+		{"get_customer_by_sender", "bank1", "get_customer_by_sender", []string{"c1", "bank1"}, "", `"receiver_id":"bank2"`},
+		{"get_customers_by_sender_and_receiver", "bank1", "get_customers_by_sender_and_receiver", []string{"bank1", "bank2"}, "", `"customer_id":"c1"`},
+		{"get_customers_by_receiver_and_sender", "bank2", "get_customers_by_receiver_and_sender", []string{"bank2", "bank1"}, "", `"customer_id":"c1"`},
+		{"get_customers_by_receiver_and_sender by unrelated entity", "bank3", "get_customers_by_receiver_and_sender", []string{"bank2", "bank1"}, ERR_UNAUTHORIZED, ""},
+		{"get_customer_history", "bank2", "get_customer_history", []string{"c1", "bank2", "bank1"}, "", `"version":1`},
+		{"get_erasure_certificates", "reg1", "get_erasure_certificates", []string{"c1"}, "", `{"certificates":[]}`},
+		{"get_erasure_certificates by a data provider", "bank3", "get_erasure_certificates", []string{"c1"}, ERR_UNAUTHORIZED, ""},
+		{"get_records_by_key_id", "bank1", "get_records_by_key_id", []string{"bank2", "x", "bank1"}, "", `{"entries":[]}`},
+		{"get_records_by_key_id of every sender by a sender", "bank1", "get_records_by_key_id", []string{"bank2", "x", ""}, ERR_UNAUTHORIZED, ""},
+		{"get_records_by_key_id invalid key ID", "bank2", "get_records_by_key_id", []string{"bank2", "x/y", ""}, ERR_VALIDATION, ""},
+		{"get_form_template unknown", "bank1", "get_form_template", []string{"kyc", "1"}, ERR_NOT_FOUND, ""},
+		{"get_all_entities with a token but no limit", "bank1", "get_all_entities", []string{"", "QUJD"}, ERR_VALIDATION, ""},
+		{"get_customers_by_receiver_id with a partial key", "bank2", "get_customers_by_receiver_id", []string{"bank2\x00c1"}, ERR_VALIDATION, ""},
+		{"unknown function", "bank1", "no_such_function", []string{}, ERR_VALIDATION, ""},
+		{"unregistered caller", "bank9", "get_all_entities", []string{}, ERR_UNAUTHORIZED, ""},
+	}
+
+	e := new_test_env(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := e.query(c.caller, c.function, c.args...)
+			if code := error_code(err); code != c.code {
+				t.Fatalf("got error code %q (%v), want %q", code, err, c.code)
+			}
+			if !strings.Contains(string(result), c.contains) {
+				t.Fatalf("result %s does not contain %s", result, c.contains)
+			}
+		})
+	}
+}
+
+//==============================================================================================================================
+//	 Scenarios
+//==============================================================================================================================
+func TestRoute(t *testing.T) {
+	e := new_test_env(t)
+
+	// query functions and invoke functions share the single Invoke entry point
+	e.stub.Caller = "bank1"
+	result, err := e.submit(func() ([]byte, error) { return e.cc.route(e.stub, "get_consent", []string{"c1", "bank2", "bank1"}) })
+	if err != nil || !strings.Contains(string(result), `"purpose":"account opening"`) {
+		t.Fatalf("get_consent: %s, %v", result, err)
+	}
+	if _, err = e.submit(func() ([]byte, error) { return e.cc.route(e.stub, "revoke_consent", []string{"c1", "bank2", "bank1"}) }); err != nil {
+		t.Fatalf("revoke_consent: %v", err)
+	}
+
+	_, err = e.submit(func() ([]byte, error) { return e.cc.route(e.stub, "no_such_function", []string{}) })
+	resp := response(nil, err)
+	var cc_err ChaincodeError
+	if resp.Status != 500 || json.Unmarshal([]byte(resp.Message), &cc_err) != nil || cc_err.Code != ERR_VALIDATION {
+		t.Fatalf("got %+v", resp)
+	}
+	if resp = response([]byte("ok"), nil); resp.Status != 200 || string(resp.Payload) != "ok" {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestRegisterAndDeleteCustomerIndexes(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c1", "bank3", "bank1", `{"name":"Alice"}`)
+
+	data_key, scr_key, src_key, rsc_key, csr_key, crs_key := create_keys("c1", "bank2", "bank1")
+	for _, key := range []string{scr_key, src_key, rsc_key, csr_key, crs_key} {
+		if string(e.stub.State[key]) != data_key {
+			t.Fatalf("index %s = %q, want %q", key, e.stub.State[key], data_key)
+		}
+	}
+	if len(e.stub.State[history_key("c1", "bank2", "bank1", 1)]) == 0 {
+		t.Fatal("version 1 not in history")
+	}
+
+	e.must_invoke("bank1", "delete_customer", "c1", "bank1", e.sign("bank1", "delete_customer", "c1", "bank1"))
+
+	for _, key_type := range []string{"D", "DH", "SCR", "SRC", "RSC", "CSR", "CRS"} {
+		if keys := e.stub.sorted(make_key(key_type)); len(keys) != 0 {
+			t.Fatalf("keys left after delete_customer: %v", keys)
+		}
+	}
+}
+
+func TestRevokeConsentPurgesData(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c2", "bank2", "bank1", `{"name":"Bob"}`)
+
+	e.must_invoke("bank2", "revoke_consent", "c1", "bank2", "bank1")
+
+	holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2"))
+	if len(holder.Entries) != 1 || holder.Entries[0].CustomerId != "c2" {
+		t.Fatalf("got %+v, want only c2", holder.Entries)
+	}
+	if keys := e.stub.sorted(make_key("CSR", "c1")); len(keys) != 0 {
+		t.Fatalf("index keys left after revoke_consent: %v", keys)
+	}
+
+	_, err := e.invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)...)
+	if error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("register_customer after revoke_consent: %v", err)
+	}
+}
+
+func TestConsentExpiry(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("cm1", "grant_consent", "c2", "bank2", "bank1", "loan", "kyc", "1500")
+	e.must_invoke("bank1", "register_customer", e.register_args("c2", "bank2", "bank1", `{"name":"Bob"}`)...)
+
+	e.stub.TxTime = 1500
+	holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2"))
+	if len(holder.Entries) != 1 || holder.Entries[0].CustomerId != "c1" {
+		t.Fatalf("got %+v, want only c1 once c2 expired", holder.Entries)
+	}
+
+	e.must_invoke("bank1", "purge_expired")
+	if _, ok := e.stub.State[get_key("data_key", "c2", "bank2", "bank1")]; ok {
+		t.Fatal("expired data not purged")
+	}
+	if _, ok := e.stub.State[get_key("data_key", "c1", "bank2", "bank1")]; !ok {
+		t.Fatal("data without expiry purged")
+	}
+
+	// a later run finds nothing left to purge, so writes nothing
+	e.stub.Caller = "bank1"
+	if _, err := e.submit(func() ([]byte, error) {
+		result, err := e.cc.invoke(e.stub, "purge_expired", []string{})
+		if len(e.stub.writes) != 0 {
+			t.Fatalf("second purge_expired wrote %d keys", len(e.stub.writes))
+		}
+		return result, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionHistory(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice Smith"}`)...)
+
+	var history DataVersion_Holder
+	if err := json.Unmarshal(e.must_query("bank1", "get_customer_history", "c1", "bank2", "bank1"), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Versions) != 2 || history.Versions[0].Version != 1 || history.Versions[1].Version != 2 {
+		t.Fatalf("got %+v, want versions 1 and 2", history.Versions)
+	}
+
+	holder := decode_customers(t, e.must_query("bank2", "get_customer", "c1", "bank2"))
+	if len(holder.Entries) != 1 || holder.Entries[0].Version != 2 || holder.Entries[0].TxId != history.Versions[1].TxId {
+		t.Fatalf("got %+v, want the latest version", holder.Entries)
+	}
+
+	// Content is the envelope itself, not an escaped string
+	holder = e.access("c1", "bank2", "account opening")
+	var env envelope.Envelope
+	if err := json.Unmarshal(holder.Entries[0].Content, &env); err != nil || env.Validate() != nil {
+		t.Fatalf("content is not an envelope: %s", holder.Entries[0].Content)
+	}
+	plaintext, err := envelope.Decrypt(e.keys["bank2"], &env)
+	if err != nil || string(plaintext) != `{"name":"Alice Smith"}` {
+		t.Fatalf("decrypted %s, %v", plaintext, err)
+	}
+}
+
+func TestEntityRoles(t *testing.T) {
+	// deployed without Init, there is no admin to start from
+	uninitialized := &test_env{t: t, cc: new(SimpleChaincode), stub: new_mem_stub(), keys: entity_keys(t)}
+	if _, err := uninitialized.invoke("bank1", "register_entity", "bank1", "Bank 1", uninitialized.public_key("bank1")); error_code(err) != ERR_UNAUTHORIZED || !strings.Contains(err.Error(), "Init") {
+		t.Fatalf("register_entity without Init: %v", err)
+	}
+
+	e := new_empty_env(t, "bank1")
+
+	// the admin named to Init registers itself and becomes an admin; after it, only admins register entities
+	if _, err := e.invoke("bank1", "register_entity", "bank2", "Bank 2", e.public_key("bank2")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("first entity registered by another: %v", err)
+	}
+	if _, err := e.invoke("bank2", "register_entity", "bank2", "Bank 2", e.public_key("bank2")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("first entity registered by another caller than the initial admin: %v", err)
+	}
+	e.must_invoke("bank1", "register_entity", "bank1", "Bank 1", e.public_key("bank1"), "consent_manager")
+	if _, err := e.invoke("bank2", "register_entity", "bank2", "Bank 2", e.public_key("bank2")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("second entity registered itself: %v", err)
+	}
+	e.must_invoke("bank1", "register_entity", "bank2", "Bank 2", e.public_key("bank2"), "data_consumer")
+
+	var entity Entity
+	if err := json.Unmarshal(e.must_query("bank2", "get_entity", "bank1"), &entity); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entity.Roles, ",") != "admin,consent_manager" {
+		t.Fatalf("got roles %v", entity.Roles)
+	}
+
+	// the consent manager grants on behalf of a sender it isn't, the sender still needs a data provider role to send
+	e.must_invoke("bank1", "grant_consent", "c1", "bank2", "bank3", "account opening", "kyc", "")
+	e.must_invoke("bank1", "register_entity", "bank3", "Bank 3", e.public_key("bank3"), "data_consumer")
+	if _, err := e.invoke("bank3", "register_customer", e.register_args("c1", "bank2", "bank3", `{"name":"Alice"}`)...); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("register_customer by a data consumer: %v", err)
+	}
+	e.must_invoke("bank1", "register_entity", "bank3", "Bank 3", e.public_key("bank3"), "data_provider")
+	e.must_invoke("bank3", "register_customer", e.register_args("c1", "bank2", "bank3", `{"name":"Alice"}`)...)
+
+	// updating an entity without roles keeps them, entities registered before roles hold the default ones
+	e.must_invoke("bank1", "register_entity", "bank3", "Bank Three", e.public_key("bank3"))
+	if err := json.Unmarshal(e.must_query("bank2", "get_entity", "bank3"), &entity); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entity.Roles, ",") != "data_provider" {
+		t.Fatalf("got roles %v", entity.Roles)
+	}
+	legacy, _ := json.Marshal(Entity{EntityId: "bank4", EntityName: "Bank 4", EntityPublicKey: e.public_key("bank4")})
+	e.stub.State[entity_key("bank4")] = legacy
+	e.must_invoke("bank1", "grant_consent", "c1", "bank2", "bank4", "account opening", "kyc", "")
+	e.must_invoke("bank4", "register_customer", e.register_args("c1", "bank2", "bank4", `{"name":"Alice"}`)...)
+}
+
+func TestBootstrapUpgradedLedger(t *testing.T) {
+	e := new_test_env(t)
+
+	// a ledger upgraded from before roles: its entities hold none, so none of them is an admin
+	for _, entity_id := range []string{"bank1", "bank2", "bank3", "cm1", "reg1"} {
+		var entity Entity
+		if err := json.Unmarshal(e.stub.State[entity_key(entity_id)], &entity); err != nil {
+			t.Fatal(err)
+		}
+		entity.Roles = nil
+		e.stub.State[entity_key(entity_id)], _ = json.Marshal(entity)
+	}
+	if _, err := e.init("", "bank2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.invoke("bank2", "register_entity", "bank4", "Bank 4", e.public_key("bank4")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("bootstrap registered another entity: %v", err)
+	}
+	if _, err := e.invoke("bank3", "register_entity", "bank3", "Bank bank3", e.public_key("bank3")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("bootstrap by an entity other than the initial admin: %v", err)
+	}
+
+	// the admin named to Init registers itself to become the first admin, keeping its key and data
+	e.must_invoke("bank2", "register_entity", "bank2", "Bank bank2", e.public_key("bank2"))
+	var entity Entity
+	if err := json.Unmarshal(e.must_query("bank1", "get_entity", "bank2"), &entity); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entity.Roles, ",") != "admin,data_consumer,data_provider" {
+		t.Fatalf("got roles %v", entity.Roles)
+	}
+	if _, err := e.invoke("bank1", "register_entity", "bank1", "Bank bank1", e.public_key("bank1")); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("second bootstrap: %v", err)
+	}
+	e.must_invoke("bank2", "register_entity", "bank4", "Bank 4", e.public_key("bank4"))
+	if holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2")); len(holder.Entries) != 1 {
+		t.Fatalf("got %+v", holder.Entries)
+	}
+}
+
+func TestRegisterCustomersBatch(t *testing.T) {
+	e := new_test_env(t)
+	for _, customer_id := range []string{"c2", "c3"} {
+		e.must_invoke("cm1", "grant_consent", customer_id, "bank2", "bank1", "account opening", "kyc", "")
+	}
+	e.must_invoke("cm1", "grant_consent", "c2", "bank3", "bank1", "account opening", "kyc", "")
+
+	var holder CustomerBatchResult_Holder
+	if err := json.Unmarshal(e.must_invoke("bank1", "register_customers_batch", e.batch_args("bank1",
+		CustomerBatchEntry{CustomerId: "c1", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c2", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c3", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c2", ReceiverId: "bank3"},
+	)...), &holder); err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, result := range holder.Results {
+		versions = append(versions, fmt.Sprintf("%s>%s:%d", result.CustomerId, result.ReceiverId, result.Version))
+	}
+	if strings.Join(versions, " ") != "c1>bank2:2 c2>bank2:1 c3>bank2:1 c2>bank3:1" {
+		t.Fatalf("got %v", versions)
+	}
+	if got := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2")); len(got.Entries) != 3 {
+		t.Fatalf("got %+v", got.Entries)
+	}
+	var report IndexReport
+	if err := json.Unmarshal(e.must_query("reg1", "verify_indexes"), &report); err != nil || len(report.Issues) != 0 {
+		t.Fatalf("got %+v, %v", report.Issues, err)
+	}
+
+	// one rejected entry rejects the batch, and every entry's result is in the error
+	before := len(e.stub.State)
+	_, err := e.invoke("bank1", "register_customers_batch", e.batch_args("bank1",
+		CustomerBatchEntry{CustomerId: "c2", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c4", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c2", ReceiverId: "bank2"},
+	)...)
+	if error_code(err) != ERR_UNAUTHORIZED || len(e.stub.State) != before {
+		t.Fatalf("got %v, %d keys written", err, len(e.stub.State)-before)
+	}
+	if err := json.Unmarshal([]byte(err.(*ChaincodeError).Details), &holder); err != nil {
+		t.Fatal(err)
+	}
+	if len(holder.Results) != 3 || holder.Results[0].Error != nil || holder.Results[1].Error.Code != ERR_UNAUTHORIZED || holder.Results[2].Error.Code != ERR_VALIDATION {
+		t.Fatalf("got %+v", holder.Results)
+	}
+}
+
+func TestExportState(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c2", "bank2", "bank1", `{"name":"Bob"}`)
+
+	var export StateExport
+	if err := json.Unmarshal(e.must_query("reg1", "export_state"), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Entries) != len(e.stub.State) || export.Next != "" {
+		t.Fatalf("exported %d of %d keys", len(export.Entries), len(e.stub.State))
+	}
+	var all []string
+	for _, entry := range export.Entries {
+		if object_type, _ := split_key(entry.Key); entry.Type != object_type {
+			t.Fatalf("key %q has type %s", entry.Key, entry.Type)
+		}
+		value := string(entry.Value)
+		if entry.Opaque {
+			json.Unmarshal(entry.Value, &value)
+		}
+		if value != string(e.stub.State[entry.Key]) {
+			t.Fatalf("key %q exported as %s", entry.Key, entry.Value)
+		}
+		all = append(all, entry.Key)
+	}
+
+	// pages go across object types and add up to the whole export
+	var paged []string
+	token := ""
+	for pages := 0; pages == 0 || token != ""; pages++ {
+		if pages > len(all) {
+			t.Fatal("paging does not terminate")
+		}
+		var page StateExport
+		if err := json.Unmarshal(e.must_query("bank1", "export_state", "", "4", token), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Entries) > 4 {
+			t.Fatalf("page of %d entries, limit is 4", len(page.Entries))
+		}
+		for _, entry := range page.Entries {
+			paged = append(paged, entry.Key)
+		}
+		token = page.Next
+	}
+	if strings.Join(paged, ",") != strings.Join(all, ",") {
+		t.Fatalf("paged export differs:\n%q\n%q", paged, all)
+	}
+
+	if err := json.Unmarshal(e.must_query("reg1", "export_state", "D/bank2"), &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Entries) != 2 || export.Entries[0].Type != "D" || export.Entries[1].Key != get_key("data_key", "c2", "bank2", "bank1") {
+		t.Fatalf("got %+v", export.Entries)
+	}
+}
+
+func TestEntityDirectory(t *testing.T) {
+	source := new_test_env(t)
+	source.must_invoke("bank2", "rotate_entity_key", "bank2", source.public_key("bank4"), source.sign("bank4", "rotate_entity_key", "bank2", source.public_key("bank4")))
+	directory := string(source.must_query("reg1", "export_entities"))
+
+	// a new channel: its first admin registers itself, then loads the membership
+	e := new_empty_env(t, "bank1")
+	e.must_invoke("bank1", "register_entity", "bank1", "Bank bank1", e.public_key("bank1"))
+
+	var report EntityImportReport
+	if err := json.Unmarshal(e.must_invoke("bank1", "import_entities", directory), &report); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.Created, ",") != "bank2,bank3,cm1,reg1" || strings.Join(report.Unchanged, ",") != "bank1" || len(report.Updated) != 0 {
+		t.Fatalf("got %+v", report)
+	}
+	for _, entity_id := range []string{"bank1", "bank2", "bank3", "cm1", "reg1"} {
+		if string(e.stub.State[entity_key(entity_id)]) != string(source.stub.State[entity_key(entity_id)]) {
+			t.Fatalf("%s imported as %s", entity_id, e.stub.State[entity_key(entity_id)])
+		}
+	}
+
+	// importing again changes nothing
+	if err := json.Unmarshal(e.must_invoke("bank1", "import_entities", directory), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unchanged) != 5 {
+		t.Fatalf("got %+v", report)
+	}
+
+	// bank3 has received data, so a directory with another key for it is refused as a whole
+	e.share("c1", "bank3", "bank1", `{"name":"Alice"}`)
+	var snapshot EntityDirectory
+	json.Unmarshal([]byte(directory), &snapshot)
+	for i := range snapshot.Entities {
+		snapshot.Entities[i].EntityName = "Renamed"
+		if snapshot.Entities[i].EntityId == "bank3" {
+			snapshot.Entities[i].EntityPublicKey = e.public_key("bank1")
+			snapshot.Entities[i].KeyId = ""
+		}
+	}
+	changed, _ := json.Marshal(snapshot)
+	before := e.snapshot_state()
+	if _, err := e.invoke("bank1", "import_entities", string(changed)); error_code(err) != ERR_CONFLICT {
+		t.Fatalf("import_entities replacing the key of a receiver with data: %v", err)
+	}
+	if after := e.snapshot_state(); after != before {
+		t.Fatal("import_entities wrote entities before refusing")
+	}
+}
+
+func TestEntityDirectoryKeyHistory(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("bank2", "rotate_entity_key", "bank2", e.public_key("bank4"), e.sign("bank4", "rotate_entity_key", "bank2", e.public_key("bank4")))
+	stored := string(e.stub.State[entity_key("bank2")])
+
+	var snapshot EntityDirectory
+	if err := json.Unmarshal(e.must_query("reg1", "export_entities"), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	bank2 := -1
+	for i := range snapshot.Entities {
+		if snapshot.Entities[i].EntityId == "bank2" {
+			bank2 = i
+		}
+	}
+	import_with := func(entity Entity) error {
+		directory := snapshot
+		directory.Entities = append([]Entity{}, snapshot.Entities...)
+		directory.Entities[bank2] = entity
+		bytes, _ := json.Marshal(directory)
+		_, err := e.invoke("bank1", "import_entities", string(bytes))
+		return err
+	}
+
+	// a directory that lost the history keeps the ledger's, so the retired key stays retired
+	entity := snapshot.Entities[bank2]
+	entity.PreviousKeys, entity.KeyValidFrom = nil, 0
+	if err := import_with(entity); err != nil {
+		t.Fatal(err)
+	}
+	if string(e.stub.State[entity_key("bank2")]) != stored {
+		t.Fatalf("import_entities replaced the key history: %s", e.stub.State[entity_key("bank2")])
+	}
+	if _, err := e.invoke("bank2", "rotate_entity_key", "bank2", e.public_key("bank2"), e.sign("bank2", "rotate_entity_key", "bank2", e.public_key("bank2"))); error_code(err) != ERR_CONFLICT {
+		t.Fatalf("rotate_entity_key back to the retired key: %v", err)
+	}
+
+	// a history that disagrees with the ledger's is refused
+	entity = snapshot.Entities[bank2]
+	entity.PreviousKeys = append([]EntityKey{}, entity.PreviousKeys...)
+	entity.PreviousKeys[0].ValidUntil++
+	if err := import_with(entity); error_code(err) != ERR_CONFLICT {
+		t.Fatalf("import_entities with a conflicting key history: %v", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	e := new_test_env(t)
+
+	// emitted returns the events of the last transaction, through the listener package
+	emitted := func() []string {
+		t.Helper()
+		var got []string
+		listener := events.NewListener()
+		listener.On("", func(event events.Event) error {
+			if event.TxId != e.stub.TxId {
+				t.Fatalf("event %+v of another transaction", event)
+			}
+			got = append(got, fmt.Sprintf("%s %s %s>%s %s v%d", event.Type, event.CustomerId, event.SenderId, event.ReceiverId, event.EntityId, event.Version))
+			return nil
+		})
+		if err := listener.Handle(events.Raw{TransactionID: e.stub.TxId, EventName: e.stub.EventName, Payload: e.stub.EventPayload}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(e.stub.EventPayload), "content") {
+			t.Fatalf("event carries content: %s", e.stub.EventPayload)
+		}
+		return got
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		if got := emitted(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("got events\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	e.must_invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice Smith"}`)...)
+	expect("data_registered c1 bank1>bank2  v2")
+
+	e.must_invoke("cm1", "grant_consent", "c2", "bank2", "bank1", "account opening", "kyc", "")
+	expect()
+	e.must_invoke("bank1", "register_customers_batch", e.batch_args("bank1",
+		CustomerBatchEntry{CustomerId: "c1", ReceiverId: "bank2"},
+		CustomerBatchEntry{CustomerId: "c2", ReceiverId: "bank2"},
+	)...)
+	expect("data_registered c1 bank1>bank2  v3", "data_registered c2 bank1>bank2  v1")
+
+	e.must_invoke("bank1", "delete_customer", "c2", "bank1", e.sign("bank1", "delete_customer", "c2", "bank1"))
+	expect("data_deleted c2 bank1>bank2  v0")
+
+	e.must_invoke("bank2", "register_customer_crossref", "c1", "bank2", "ref2")
+	expect("crossref_registered c1 > bank2 v0")
+	e.must_invoke("bank2", "delete_customer_crossref", "bank2", "ref2", e.sign("bank2", "delete_customer_crossref", "bank2", "ref2"))
+	expect("crossref_deleted c1 > bank2 v0")
+
+	e.must_invoke("bank1", "register_entity", "bank4", "Bank 4", e.public_key("bank4"))
+	expect("entity_registered  > bank4 v0")
+	e.must_invoke("bank4", "rotate_entity_key", "bank4", e.public_key("bank1"), e.sign("bank1", "rotate_entity_key", "bank4", e.public_key("bank1")))
+	expect("entity_key_rotated  > bank4 v0")
+	e.must_invoke("bank1", "delete_entity", "bank4", e.sign("bank1", "delete_entity", "bank4"))
+	expect("entity_deleted  > bank4 v0")
+	// deleting an entity that isn't there deletes nothing, so tells nothing
+	if _, err := e.invoke("bank1", "delete_entity", "bank4", e.sign("bank1", "delete_entity", "bank4")); error_code(err) != ERR_NOT_FOUND {
+		t.Fatalf("delete_entity of a deleted entity: %v", err)
+	}
+	expect()
+
+	// the events of a failed transaction are dropped with its writes: erase_customer deletes c1's data before it
+	// runs into the corrupt consent
+	e.stub.State[consent_key("c1", "bank2", "bank1")] = []byte("corrupt")
+	before := e.snapshot_state()
+	if _, err := e.invoke("cm1", "erase_customer", "c1", e.sign("cm1", "erase_customer", "c1")); error_code(err) != ERR_INTERNAL {
+		t.Fatalf("erase_customer with a corrupt consent: %v", err)
+	}
+	expect()
+	if after := e.snapshot_state(); after != before {
+		t.Fatalf("failed transaction changed the state:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	e := new_test_env(t)
+	for i := 2; i <= 5; i++ {
+		e.share(fmt.Sprintf("c%d", i), "bank2", "bank1", `{"name":"Bob"}`)
+	}
+
+	var seen []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging does not terminate")
+		}
+		holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2", "2", token))
+		if len(holder.Entries) > 2 {
+			t.Fatalf("page of %d entries, limit is 2", len(holder.Entries))
+		}
+		for _, entry := range holder.Entries {
+			seen = append(seen, entry.CustomerId)
+		}
+		if holder.Next == "" {
+			break
+		}
+		token = holder.Next
+	}
+	if strings.Join(seen, ",") != "c1,c2,c3,c4,c5" {
+		t.Fatalf("got %v", seen)
+	}
+
+	// index keys whose data is gone are left out rather than listed without data
+	delete(e.stub.State, get_key("data_key", "c3", "bank2", "bank1"))
+	holder := decode_customers(t, e.must_query("bank1", "get_customers_by_sender_id", "bank1"))
+	if len(holder.Entries) != 4 {
+		t.Fatalf("got %+v, want c3 left out", holder.Entries)
+	}
+	for _, entry := range holder.Entries {
+		if entry.CustomerId == "c3" {
+			t.Fatalf("got %+v, want c3 left out", holder.Entries)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	e := new_test_env(t)
+
+	// only get_customer_content returns Content, and only under a committed access record
+	key_id, _ := envelope.KeyID(e.public_key("bank2"))
+	for _, query := range [][]string{
+		{"get_customer", "c1", "bank2"},
+		{"get_customers_by_receiver_id", "bank2"},
+		{"get_customers_by_receiver_and_sender", "bank2", "bank1"},
+		{"get_records_by_key_id", "bank2", key_id, ""},
+		{"get_customer_history", "c1", "bank2", "bank1"},
+	} {
+		if result := e.must_query("bank2", query[0], query[1:]...); !strings.Contains(string(result), `"tx_id":"tx`) || strings.Contains(string(result), `"content"`) {
+			t.Fatalf("%s returned %s, want data without content", query[0], result)
+		}
+	}
+	// a client evaluating access_customer rather than submitting it gets no content, and leaves no record
+	e.stub.Caller = "bank2"
+	result, err := e.cc.route(e.stub, "access_customer", []string{"c1", "bank2", "fraud check"})
+	e.stub.rollback()
+	if err != nil || strings.Contains(string(result), `"content"`) {
+		t.Fatalf("access_customer returned %s, %v, want the access record only", result, err)
+	}
+	var evaluated AccessRecord
+	if err := json.Unmarshal(result, &evaluated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.query("bank2", "get_customer_content", "c1", "bank2", evaluated.TxId); error_code(err) != ERR_NOT_FOUND {
+		t.Fatalf("get_customer_content under an evaluated access: %v", err)
+	}
+
+	holder := e.access("c1", "bank2", "fraud check")
+	if len(holder.Entries) != 1 || len(holder.Entries[0].Content) == 0 {
+		t.Fatalf("got %+v", holder.Entries)
+	}
+	access_tx_id := e.stub.TxId
+	if _, err := e.query("bank3", "get_customer_content", "c1", "bank3", access_tx_id); error_code(err) != ERR_NOT_FOUND {
+		t.Fatalf("get_customer_content under another receiver's access record: %v", err)
+	}
+
+	// a record covers the data as it was: a later version needs a new one
+	e.stub.TxTime++
+	e.must_invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice Smith"}`)...)
+	holder = decode_customers(t, e.must_query("bank2", "get_customer_content", "c1", "bank2", access_tx_id))
+	if len(holder.Entries) != 1 || len(holder.Entries[0].Content) != 0 {
+		t.Fatalf("got %+v, want the new version without content", holder.Entries)
+	}
+
+	var log AccessRecord_Holder
+	if err := json.Unmarshal(e.must_query("bank1", "get_access_log", "customer", "c1"), &log); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.Entries) != 1 || log.Entries[0].AccessorId != "bank2" || log.Entries[0].Purpose != "fraud check" {
+		t.Fatalf("got %+v", log.Entries)
+	}
+
+	// the consent manager reads the whole log; a sender to another receiver sees none of bank2's reads
+	e.must_invoke("cm1", "grant_consent", "c1", "bank1", "bank3", "loan", "kyc", "")
+	for caller, want := range map[string]int{"cm1": 1, "bank1": 1, "bank2": 1, "bank3": 0} {
+		log = AccessRecord_Holder{}
+		if err := json.Unmarshal(e.must_query(caller, "get_access_log", "customer", "c1"), &log); err != nil {
+			t.Fatal(err)
+		}
+		if len(log.Entries) != want {
+			t.Fatalf("%s got %+v, want %d entries", caller, log.Entries, want)
+		}
+	}
+}
+
+func TestSharingMap(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c1", "bank3", "bank2", `{"name":"Alice"}`)
+
+	// a party to some flows only sees those; the consent manager and the regulator see them all
+	for caller, want := range map[string]string{
+		"bank1": "bank1>bank2",
+		"bank3": "bank2>bank3",
+		"bank2": "bank1>bank2,bank2>bank3",
+		"cm1":   "bank1>bank2,bank2>bank3",
+		"reg1":  "bank1>bank2,bank2>bank3",
+	} {
+		var sharing_map SharingMap
+		if err := json.Unmarshal(e.must_query(caller, "get_customer_sharing_map", "c1"), &sharing_map); err != nil {
+			t.Fatal(err)
+		}
+		var flows []string
+		for _, flow := range sharing_map.Flows {
+			flows = append(flows, flow.SenderId+">"+flow.ReceiverId)
+		}
+		sort.Strings(flows)
+		if strings.Join(flows, ",") != want {
+			t.Fatalf("%s got %v, want %s", caller, flows, want)
+		}
+	}
+}
+
+func TestCrossrefDuplicates(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("bank1", "register_customer_crossref", "c1", "bank1", "ref2")
+
+	if _, err := e.invoke("bank1", "register_customer_crossref", "c2", "bank1", "ref2"); error_code(err) != ERR_DUPLICATE {
+		t.Fatalf("duplicate ref for another customer: %v", err)
+	}
+
+	e.must_invoke("bank1", "delete_customer_crossref", "bank1", "ref1", e.sign("bank1", "delete_customer_crossref", "bank1", "ref1"))
+	var holder CustRef_Holder
+	if err := json.Unmarshal(e.stub.State[custid_key("c1")], &holder); err != nil || len(holder.CustRefs) != 1 || holder.CustRefs[0].CustomerRef != "ref2" {
+		t.Fatalf("got %s", e.stub.State[custid_key("c1")])
+	}
+
+	e.must_invoke("bank1", "delete_customer_crossref", "bank1", "ref2", e.sign("bank1", "delete_customer_crossref", "bank1", "ref2"))
+	if keys := append(e.stub.sorted(make_key("CUSTID")), e.stub.sorted(make_key("CUSTREF"))...); len(keys) != 0 {
+		t.Fatalf("keys left after deleting every crossref: %v", keys)
+	}
+
+	// once deleted, the ref can be registered again
+	e.must_invoke("bank1", "register_customer_crossref", "c2", "bank1", "ref1")
+}
+
+func TestCrossrefOwnRefs(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("bank2", "register_customer_crossref", "c1", "bank2", "ref2")
+
+	// an entity only learns its own refs for the customer, not those other entities keep
+	for caller, want := range map[string]string{"bank1": "ref1", "bank2": "ref2"} {
+		var holder CustRef_Holder
+		if err := json.Unmarshal(e.must_query(caller, "get_customer_crossref", caller, want), &holder); err != nil {
+			t.Fatal(err)
+		}
+		if len(holder.CustRefs) != 1 || holder.CustRefs[0] != (CustRef{EntityId: caller, CustomerRef: want}) {
+			t.Fatalf("%s got %+v", caller, holder.CustRefs)
+		}
+	}
+}
+
+func TestIdPattern(t *testing.T) {
+	e := new_test_env(t)
+
+	if _, err := e.init("[a-z"); error_code(err) != ERR_VALIDATION {
+		t.Fatalf("invalid pattern: %v", err)
+	}
+	if _, err := e.init("", "bank 1"); error_code(err) != ERR_VALIDATION {
+		t.Fatalf("invalid admin entity ID: %v", err)
+	}
+
+	// the pattern has to match the whole ID
+	e.must_invoke("cm1", "grant_consent", "c2", "bank2", "bank1", "loan", "kyc", "")
+	if _, err := e.init("c[0-9]+|bank[0-9]+"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.invoke("cm1", "grant_consent", "c2x", "bank2", "bank1", "loan", "kyc", ""); error_code(err) != ERR_VALIDATION {
+		t.Fatalf("ID partly matching the pattern: %v", err)
+	}
+
+	// with a pattern allowing "/", IDs containing it no longer run into each other
+	if _, err := e.init("[a-z0-9/]+"); err != nil {
+		t.Fatal(err)
+	}
+	// an upgrade without a pattern keeps it
+	if _, err := e.init(); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := get_config(e.stub); err != nil || config.IdPattern != "[a-z0-9/]+" {
+		t.Fatalf("got %+v, %v", config, err)
+	}
+	e.share("c1/x", "bank2", "bank1", `{"name":"Carol"}`)
+	holder := decode_customers(t, e.must_query("bank2", "get_customer", "c1", "bank2"))
+	if len(holder.Entries) != 1 {
+		t.Fatalf("got %+v, want only c1", holder.Entries)
+	}
+	e.must_invoke("bank1", "delete_customer", "c1", "bank1", e.sign("bank1", "delete_customer", "c1", "bank1"))
+	holder = decode_customers(t, e.must_query("bank2", "get_customer", "c1/x", "bank2"))
+	if len(holder.Entries) != 1 {
+		t.Fatalf("delete_customer of c1 removed c1/x: %+v", holder.Entries)
+	}
+}
+
+// legacy_key returns the "/" separated key written for a composite key by earlier versions.
+func legacy_key(key string) string {
+	key_type, ids := split_key(key)
+	return strings.Join(append([]string{key_type}, ids...), "/")
+}
+
+func TestMigrateKeys(t *testing.T) {
+	e := new_test_env(t)
+	e.must_invoke("bank2", "access_customer", "c1", "bank2", "fraud check")
+
+	// rewrite the ledger the way earlier versions stored it
+	want := map[string][]byte{}
+	legacy := new_mem_stub()
+	for key, val := range e.stub.State {
+		// earlier versions kept no key ID index, repair_indexes adds it, nor a CONFIG record, Init writes it
+		if key_type, _ := split_key(key); key_type == "KID" || key_type == "CONFIG" {
+			continue
+		}
+		want[key] = val
+		if key_type, ids := split_key(string(val)); key_type != "" && len(ids) > 0 {
+			val = []byte(legacy_key(string(val)))
+		}
+		legacy.State[legacy_key(key)] = val
+	}
+	legacy.State["D/bank2/c/9/bank1"] = []byte("ambiguous")
+	e.stub = legacy
+	if _, err := e.init("", "bank1"); err != nil {
+		t.Fatal(err)
+	}
+	want[make_key("CONFIG")] = e.stub.State[make_key("CONFIG")]
+
+	// no entity is found under its new key yet, so only the admin named to Init can start; once bank1 is moved,
+	// only an admin goes on
+	if _, err := e.invoke("bank9", "migrate_keys", "5"); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("migrate_keys by another caller than the initial admin: %v", err)
+	}
+	var report MigrationReport
+	for runs := 0; runs == 0 || report.More; runs++ {
+		if runs > len(want) {
+			t.Fatal("migrate_keys does not terminate")
+		}
+		if err := json.Unmarshal(e.must_invoke("bank1", "migrate_keys", "5"), &report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.invoke("bank9", "migrate_keys", "5"); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("migrate_keys by an unregistered caller after migration: %v", err)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0] != "D/bank2/c/9/bank1" {
+		t.Fatalf("got skipped %v", report.Skipped)
+	}
+
+	delete(e.stub.State, "D/bank2/c/9/bank1")
+	if len(e.stub.State) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(e.stub.State), len(want))
+	}
+	for key, val := range want {
+		if string(e.stub.State[key]) != string(val) {
+			t.Fatalf("key %q = %s, want %s", key, e.stub.State[key], val)
+		}
+	}
+
+	// the migrated ledger works as before
+	holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2"))
+	if len(holder.Entries) != 1 || holder.Entries[0].CustomerId != "c1" {
+		t.Fatalf("got %+v", holder.Entries)
+	}
+	e.must_query("bank1", "get_customer_id_by_crossref", "bank1", "ref1")
+	e.must_query("bank2", "get_access_log", "entity", "bank2")
+}
+
+func TestVerifyAndRepairIndexes(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c2", "bank2", "bank1", `{"name":"Bob"}`)
+	e.must_invoke("bank1", "register_customer_crossref", "c2", "bank1", "ref2")
+
+	data_key, scr_key, _, rsc_key, _, _ := create_keys("c1", "bank2", "bank1")
+	state := e.stub.State
+	delete(state, scr_key)
+	state[rsc_key] = []byte(get_key("data_key", "c2", "bank2", "bank1"))
+	state[get_key("csr_key", "c9", "bank2", "bank1")] = []byte(get_key("data_key", "c9", "bank2", "bank1"))
+	delete(state, history_key("c2", "bank2", "bank1", 1))
+	state[history_key("c9", "bank2", "bank1", 1)] = []byte(`{}`)
+	delete(state, custref_key("bank1", "ref1"))
+	state[custref_key("bank1", "ref9")] = []byte(custid_key("c9"))
+	state[custid_key("c2")] = []byte(`{"custrefs":[{"entity_id":"bank1","customer_ref":"ref2"},{"entity_id":"bank1","customer_ref":"ref1"}]}`)
+	state[custref_key("bank1", "ref1")] = []byte(custid_key("c3"))
+
+	want := []string{
+		"SCR [bank1 c1 bank2] missing ",
+		"RSC [bank2 bank1 c1] mismatch ",
+		"DH [bank2 c2 bank1 0000000001] missing ",
+		"CSR [c9 bank1 bank2] orphan ",
+		"DH [bank2 c9 bank1 0000000001] orphan ",
+		"CUSTREF [bank1 ref9] orphan ",
+		"CUSTREF [bank1 ref1] mismatch ",
+		"CUSTID [c2] duplicate bank1 ref1",
+	}
+	issues := func(bytes []byte) []string {
+		var report IndexReport
+		if err := json.Unmarshal(bytes, &report); err != nil {
+			t.Fatal(err)
+		}
+		if report.Checked != 4 {
+			t.Fatalf("checked %d records, want 4", report.Checked)
+		}
+		got := []string{}
+		for _, issue := range report.Issues {
+			got = append(got, fmt.Sprintf("%s %v %s %s", issue.ObjectType, issue.Ids, issue.Problem, issue.Detail))
+		}
+		return got
+	}
+
+	if got := issues(e.must_query("bank1", "verify_indexes")); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("verify_indexes reported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := issues(e.must_invoke("bank1", "repair_indexes")); len(got) != len(want) {
+		t.Fatalf("repair_indexes fixed %v", got)
+	}
+	if got := issues(e.must_query("bank1", "verify_indexes")); len(got) != 0 {
+		t.Fatalf("issues left after repair_indexes: %v", got)
+	}
+
+	if string(state[scr_key]) != data_key || string(state[rsc_key]) != data_key {
+		t.Fatal("index keys not rebuilt")
+	}
+	if customer_id := e.must_query("bank1", "get_customer_id_by_crossref", "bank1", "ref1"); string(customer_id) != "c1" {
+		t.Fatalf("ref1 points to %s, want c1", customer_id)
+	}
+	if string(state[custid_key("c2")]) != `{"custrefs":[{"entity_id":"bank1","customer_ref":"ref2"}]}` {
+		t.Fatalf("got %s", state[custid_key("c2")])
+	}
+}
+
+func TestEraseCustomer(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c1", "bank3", "bank1", `{"name":"Alice"}`)
+	e.share("c1", "bank1", "bank3", `{"name":"Alice"}`)
+	e.share("c2", "bank2", "bank1", `{"name":"Bob"}`)
+	e.must_invoke("bank2", "register_customer_crossref", "c1", "bank2", "ref2")
+	e.must_invoke("bank2", "register_customer_crossref", "c2", "bank2", "ref3")
+	e.must_invoke("bank1", "revoke_consent", "c1", "bank1", "bank3")
+	// data whose CSR index key was lost is found through CRS
+	delete(e.stub.State, get_key("csr_key", "c1", "bank3", "bank1"))
+
+	var certificate ErasureCertificate
+	if err := json.Unmarshal(e.must_invoke("cm1", "erase_customer", "c1", e.sign("cm1", "erase_customer", "c1")), &certificate); err != nil {
+		t.Fatal(err)
+	}
+	if certificate.CustomerId != "c1" || certificate.RequestedBy != "cm1" || certificate.Records != 2 || certificate.Crossrefs != 2 || certificate.ConsentsRevoked != 2 {
+		t.Fatalf("got %+v", certificate)
+	}
+
+	for key := range e.stub.State {
+		object_type, ids := split_key(key)
+		if object_type == "CONSENT" || object_type == "ERASURE" || object_type == "ACCESS" {
+			continue
+		}
+		for _, id := range ids {
+			if id == "c1" {
+				t.Fatalf("key %q left after erase_customer", key)
+			}
+		}
+	}
+	if _, err := e.query("bank2", "get_customer_id_by_crossref", "bank2", "ref3"); err != nil {
+		t.Fatalf("crossref of another customer removed: %v", err)
+	}
+	if holder := decode_customers(t, e.must_query("bank2", "get_customers_by_receiver_id", "bank2")); len(holder.Entries) != 1 {
+		t.Fatalf("got %+v, want only c2", holder.Entries)
+	}
+
+	// the consents are revoked, so the data can't come back without a new one
+	if _, err := e.invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)...); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("register_customer after erase_customer: %v", err)
+	}
+
+	var certificates ErasureCertificate_Holder
+	if err := json.Unmarshal(e.must_query("reg1", "get_erasure_certificates", "c1"), &certificates); err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates.Certificates) != 1 || certificates.Certificates[0] != certificate {
+		t.Fatalf("got %+v", certificates.Certificates)
+	}
+}
+
+func TestRotateEntityKey(t *testing.T) {
+	e := new_test_env(t)
+	e.share("c2", "bank2", "bank1", `{"name":"Bob"}`)
+	e.share("c3", "bank2", "bank3", `{"name":"Carol"}`)
+
+	old_key := e.public_key("bank2")
+	old_key_id, _ := envelope.KeyID(old_key)
+	new_key := e.public_key("bank4")
+	new_key_id, _ := envelope.KeyID(new_key)
+
+	e.stub.TxTime = 2000
+	var entity Entity
+	if err := json.Unmarshal(e.must_invoke("bank2", "rotate_entity_key", "bank2", new_key, e.sign("bank4", "rotate_entity_key", "bank2", new_key)), &entity); err != nil {
+		t.Fatal(err)
+	}
+	want := EntityKey{KeyId: old_key_id, PublicKey: old_key, ValidFrom: 1000, ValidUntil: 2000}
+	if entity.KeyId != new_key_id || entity.KeyValidFrom != 2000 || len(entity.PreviousKeys) != 1 || entity.PreviousKeys[0] != want {
+		t.Fatalf("got %+v", entity)
+	}
+
+	// bank2 holds bank4's key from now on
+	keys := map[string]crypto.Signer{}
+	for entity_id, key := range e.keys {
+		keys[entity_id] = key
+	}
+	keys["bank2"] = keys["bank4"]
+	e.keys = keys
+
+	// a retired key can't be used again, nor receive new data
+	if _, err := e.invoke("bank2", "rotate_entity_key", "bank2", old_key, e.sign("bank3", "rotate_entity_key", "bank2", old_key)); error_code(err) != ERR_UNAUTHORIZED {
+		t.Fatalf("rotate_entity_key signed by another key: %v", err)
+	}
+	env, _ := envelope.Encrypt(old_key, []byte(`{"name":"Alice"}`))
+	bytes, _ := json.Marshal(env)
+	if _, err := e.invoke("bank1", "register_customer", "c1", "bank2", "bank1", string(bytes), e.sign("bank1", "register_customer", "c1", "bank2", "bank1", string(bytes))); error_code(err) != ERR_VALIDATION {
+		t.Fatalf("register_customer to the retired key: %v", err)
+	}
+
+	stale := func(caller string, key_id string, sender_id string) []CustomerData {
+		t.Helper()
+		return decode_customers(t, e.must_query(caller, "get_records_by_key_id", "bank2", key_id, sender_id)).Entries
+	}
+	if got := stale("bank2", old_key_id, ""); len(got) != 3 || got[0].KeyId != old_key_id {
+		t.Fatalf("got %+v", got)
+	}
+	if got := stale("bank1", old_key_id, "bank1"); len(got) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+
+	// senders re-submit until nothing references the retired key
+	e.must_invoke("bank1", "register_customer", e.register_args("c1", "bank2", "bank1", `{"name":"Alice"}`)...)
+	e.must_invoke("bank1", "register_customer", e.register_args("c2", "bank2", "bank1", `{"name":"Bob"}`)...)
+	if got := stale("bank1", old_key_id, "bank1"); len(got) != 0 {
+		t.Fatalf("got %+v", got)
+	}
+	if got := stale("bank2", new_key_id, ""); len(got) != 2 || got[0].KeyId != new_key_id || got[0].Version != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	e.must_invoke("bank3", "register_customer", e.register_args("c3", "bank2", "bank3", `{"name":"Carol"}`)...)
+	if got := stale("bank2", old_key_id, ""); len(got) != 0 {
+		t.Fatalf("got %+v", got)
+	}
+
+	var report IndexReport
+	if err := json.Unmarshal(e.must_query("reg1", "verify_indexes"), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("got %+v", report.Issues)
+	}
+}
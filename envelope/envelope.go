@@ -0,0 +1,388 @@
+// Package envelope encrypts and decrypts customer data for a receiving entity off-chain.
+//
+// register_customer only accepts Content that is an Envelope encrypted to the receiver's current
+// EntityPublicKey. An Envelope is a JWE-style JSON object:
+//
+//	{
+//	  "kid": "<KeyID of the receiver's public key>",
+//	  "alg": "RSA-OAEP-256" | "ECDH-ES",
+//	  "enc": "A256GCM",
+//	  "fields": ["<top-level field names of the plaintext, when it is a JSON object>"],
+//	  "encrypted_key": "<RSA-OAEP-256 only: the content key encrypted to the receiver>",
+//	  "epk": "<ECDH-ES only: the sender's ephemeral P-256 public key, uncompressed point>",
+//	  "iv": "...",
+//	  "ciphertext": "...",
+//	  "tag": "..."
+//	}
+//
+// All binary values are base64url encoded without padding. kid, alg, enc, fields and epk are bound to the
+// ciphertext as AES-GCM additional authenticated data.
+//
+// fields lets the ledger check a submission against a consent form template without seeing the data:
+// Encrypt declares the field names of a JSON object plaintext, and Decrypt refuses plaintext whose
+// fields differ from the declared ones.
+package envelope
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	AlgRSAOAEP256 = "RSA-OAEP-256"
+	AlgECDHES     = "ECDH-ES"
+	EncA256GCM    = "A256GCM"
+)
+
+const (
+	keySize = 32
+	ivSize  = 12
+	tagSize = 16
+	epkSize = 65
+)
+
+var b64 = base64.RawURLEncoding
+
+// Envelope is customer data encrypted for a single receiving entity.
+type Envelope struct {
+	Kid          string   `json:"kid"`
+	Alg          string   `json:"alg"`
+	Enc          string   `json:"enc"`
+	Fields       []string `json:"fields,omitempty"`
+	EncryptedKey string   `json:"encrypted_key,omitempty"`
+	Epk          string   `json:"epk,omitempty"`
+	Iv           string   `json:"iv"`
+	Ciphertext   string   `json:"ciphertext"`
+	Tag          string   `json:"tag"`
+}
+
+// KeyID returns the key ID of a PEM encoded public key: the base64url encoded SHA-256 digest of its
+// DER encoded SubjectPublicKeyInfo.
+func KeyID(publicKey string) (string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return "", errors.New("envelope: public key is not PEM encoded")
+	}
+	digest := sha256.Sum256(block.Bytes)
+	return b64.EncodeToString(digest[:]), nil
+}
+
+// Parse decodes data as an Envelope and checks that it is structurally valid.
+func Parse(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, errors.New("envelope: not a JSON envelope: " + err.Error())
+	}
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Validate checks that every field required by the algorithm is present and has the expected size.
+// It does not decrypt anything.
+func (e *Envelope) Validate() error {
+	if e.Kid == "" {
+		return errors.New("envelope: missing kid")
+	}
+	if e.Enc != EncA256GCM {
+		return fmt.Errorf("envelope: unsupported enc %q", e.Enc)
+	}
+
+	switch e.Alg {
+	case AlgRSAOAEP256:
+		if e.Epk != "" {
+			return errors.New("envelope: epk is not used with " + AlgRSAOAEP256)
+		}
+		if _, err := decodeField("encrypted_key", e.EncryptedKey, -1); err != nil {
+			return err
+		}
+	case AlgECDHES:
+		if e.EncryptedKey != "" {
+			return errors.New("envelope: encrypted_key is not used with " + AlgECDHES)
+		}
+		if _, err := decodeField("epk", e.Epk, epkSize); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("envelope: unsupported alg %q", e.Alg)
+	}
+
+	if _, err := decodeField("iv", e.Iv, ivSize); err != nil {
+		return err
+	}
+	if _, err := decodeField("ciphertext", e.Ciphertext, -1); err != nil {
+		return err
+	}
+	if _, err := decodeField("tag", e.Tag, tagSize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckRecipient returns an error unless the envelope was encrypted to publicKey with an algorithm
+// suitable for that key type.
+func (e *Envelope) CheckRecipient(publicKey string) error {
+	kid, err := KeyID(publicKey)
+	if err != nil {
+		return err
+	}
+	if e.Kid != kid {
+		return errors.New("envelope: kid does not match the receiver's public key")
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if e.Alg != AlgRSAOAEP256 {
+			return errors.New("envelope: RSA keys require " + AlgRSAOAEP256)
+		}
+	case *ecdsa.PublicKey:
+		if e.Alg != AlgECDHES {
+			return errors.New("envelope: EC keys require " + AlgECDHES)
+		}
+	}
+	return nil
+}
+
+// Encrypt encrypts plaintext for the holder of the PEM encoded publicKey.
+func Encrypt(publicKey string, plaintext []byte) (*Envelope, error) {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyID(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{Kid: kid, Enc: EncA256GCM, Fields: objectFields(plaintext)}
+	var cek []byte
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		env.Alg = AlgRSAOAEP256
+		cek = make([]byte, keySize)
+		if _, err := rand.Read(cek); err != nil {
+			return nil, err
+		}
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k, cek, nil)
+		if err != nil {
+			return nil, err
+		}
+		env.EncryptedKey = b64.EncodeToString(encryptedKey)
+	case *ecdsa.PublicKey:
+		env.Alg = AlgECDHES
+		recipient, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		z, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		cek = concatKDF(z)
+		env.Epk = b64.EncodeToString(ephemeral.PublicKey().Bytes())
+	}
+
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, env.aad())
+
+	env.Iv = b64.EncodeToString(iv)
+	env.Ciphertext = b64.EncodeToString(sealed[:len(sealed)-tagSize])
+	env.Tag = b64.EncodeToString(sealed[len(sealed)-tagSize:])
+	return env, nil
+}
+
+// Decrypt decrypts the envelope with the receiver's private key, which must be an *rsa.PrivateKey
+// or an *ecdsa.PrivateKey matching the envelope's alg.
+func Decrypt(privateKey crypto.PrivateKey, env *Envelope) ([]byte, error) {
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+
+	var cek []byte
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if env.Alg != AlgRSAOAEP256 {
+			return nil, errors.New("envelope: RSA keys require " + AlgRSAOAEP256)
+		}
+		encryptedKey, _ := b64.DecodeString(env.EncryptedKey)
+		var err error
+		cek, err = rsa.DecryptOAEP(sha256.New(), nil, k, encryptedKey, nil)
+		if err != nil {
+			return nil, errors.New("envelope: unable to decrypt the content key")
+		}
+	case *ecdsa.PrivateKey:
+		if env.Alg != AlgECDHES {
+			return nil, errors.New("envelope: EC keys require " + AlgECDHES)
+		}
+		private, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		epk, _ := b64.DecodeString(env.Epk)
+		ephemeral, err := ecdh.P256().NewPublicKey(epk)
+		if err != nil {
+			return nil, errors.New("envelope: invalid epk")
+		}
+		z, err := private.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		cek = concatKDF(z)
+	default:
+		return nil, errors.New("envelope: unsupported private key type")
+	}
+	if len(cek) != keySize {
+		return nil, errors.New("envelope: invalid content key")
+	}
+
+	iv, _ := b64.DecodeString(env.Iv)
+	ciphertext, _ := b64.DecodeString(env.Ciphertext)
+	tag, _ := b64.DecodeString(env.Tag)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), env.aad())
+	if err != nil {
+		return nil, errors.New("envelope: decryption failed")
+	}
+	if !sameFields(env.Fields, objectFields(plaintext)) {
+		return nil, errors.New("envelope: plaintext fields do not match the declared fields")
+	}
+	return plaintext, nil
+}
+
+// aad returns the additional authenticated data binding the header fields to the ciphertext.
+func (e *Envelope) aad() []byte {
+	header, _ := json.Marshal(struct {
+		Kid    string   `json:"kid"`
+		Alg    string   `json:"alg"`
+		Enc    string   `json:"enc"`
+		Fields []string `json:"fields,omitempty"`
+		Epk    string   `json:"epk,omitempty"`
+	}{e.Kid, e.Alg, e.Enc, e.Fields, e.Epk})
+	return header
+}
+
+// objectFields returns the sorted top-level field names of plaintext, or nil if it is not a JSON object.
+func objectFields(plaintext []byte) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(plaintext, &object); err != nil || object == nil {
+		return nil
+	}
+	fields := make([]string, 0, len(object))
+	for name := range object {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func sameFields(declared, actual []string) bool {
+	if len(declared) != len(actual) {
+		return false
+	}
+	sorted := append([]string(nil), declared...)
+	sort.Strings(sorted)
+	for i := range sorted {
+		if sorted[i] != actual[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// concatKDF derives the 256 bit A256GCM content key from the ECDH shared secret as in RFC 7518 section 4.6,
+// with empty PartyUInfo and PartyVInfo. A single SHA-256 round yields the whole key.
+func concatKDF(z []byte) []byte {
+	h := sha256.New()
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], 1)
+	h.Write(n[:])
+	h.Write(z)
+	binary.BigEndian.PutUint32(n[:], uint32(len(EncA256GCM)))
+	h.Write(n[:])
+	h.Write([]byte(EncA256GCM))
+	binary.BigEndian.PutUint32(n[:], 0)
+	h.Write(n[:]) // PartyUInfo
+	h.Write(n[:]) // PartyVInfo
+	binary.BigEndian.PutUint32(n[:], keySize*8)
+	h.Write(n[:])
+	return h.Sum(nil)
+}
+
+func decodeField(name, value string, size int) ([]byte, error) {
+	if value == "" {
+		return nil, errors.New("envelope: missing " + name)
+	}
+	decoded, err := b64.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("envelope: " + name + " is not base64url encoded")
+	}
+	if size >= 0 && len(decoded) != size {
+		return nil, fmt.Errorf("envelope: %s must be %d bytes", name, size)
+	}
+	return decoded, nil
+}
+
+func parsePublicKey(publicKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("envelope: public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("envelope: unable to parse public key: " + err.Error())
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("envelope: unsupported ECDSA curve, P-256 is required")
+		}
+		return k, nil
+	}
+	return nil, errors.New("envelope: unsupported public key type")
+}
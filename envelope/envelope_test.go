@@ -0,0 +1,202 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+var testKeys map[string]crypto.Signer
+
+// keys returns an RSA and a P-256 key, generated once for the package's tests.
+func keys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	if testKeys != nil {
+		return testKeys
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys = map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}
+	return testKeys
+}
+
+func publicPEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func encrypt(t *testing.T, key crypto.Signer, plaintext string) *Envelope {
+	t.Helper()
+	env, err := Encrypt(publicPEM(t, key), []byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, alg := range map[string]string{"rsa": AlgRSAOAEP256, "ec": AlgECDHES} {
+		t.Run(name, func(t *testing.T) {
+			key := keys(t)[name]
+			env := encrypt(t, key, `{"name":"Alice","address":"Tokyo"}`)
+			if env.Alg != alg || strings.Join(env.Fields, ",") != "address,name" {
+				t.Fatalf("got alg %s, fields %v", env.Alg, env.Fields)
+			}
+			if err := env.CheckRecipient(publicPEM(t, key)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the envelope goes through the ledger as JSON
+			data, _ := json.Marshal(env)
+			parsed, err := Parse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := Decrypt(key, parsed)
+			if err != nil || string(plaintext) != `{"name":"Alice","address":"Tokyo"}` {
+				t.Fatalf("decrypted %s, %v", plaintext, err)
+			}
+
+			// plaintext that is no JSON object declares no fields
+			env = encrypt(t, key, "not an object")
+			if env.Fields != nil {
+				t.Fatalf("got fields %v", env.Fields)
+			}
+			if plaintext, err := Decrypt(key, env); err != nil || string(plaintext) != "not an object" {
+				t.Fatalf("decrypted %s, %v", plaintext, err)
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	other, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		key    string
+		tamper func(*Envelope)
+	}{
+		{"kid", "ec", func(e *Envelope) { e.Kid = "another-key" }},
+		{"kid with RSA", "rsa", func(e *Envelope) { e.Kid = "another-key" }},
+		{"fields", "ec", func(e *Envelope) { e.Fields = append(e.Fields, "age") }},
+		{"fields removed", "rsa", func(e *Envelope) { e.Fields = nil }},
+		{"epk", "ec", func(e *Envelope) { e.Epk = b64.EncodeToString(other.PublicKey().Bytes()) }},
+		{"tag", "ec", func(e *Envelope) { e.Tag = flip(e.Tag) }},
+		{"tag with RSA", "rsa", func(e *Envelope) { e.Tag = flip(e.Tag) }},
+		{"ciphertext", "ec", func(e *Envelope) { e.Ciphertext = flip(e.Ciphertext) }},
+		{"iv", "rsa", func(e *Envelope) { e.Iv = flip(e.Iv) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := keys(t)[test.key]
+			env := encrypt(t, key, `{"name":"Alice"}`)
+			test.tamper(env)
+			if plaintext, err := Decrypt(key, env); err == nil {
+				t.Fatalf("decrypted %s", plaintext)
+			}
+		})
+	}
+}
+
+// flip changes the first byte of a base64url value, keeping its size.
+func flip(value string) string {
+	decoded, _ := b64.DecodeString(value)
+	decoded[0] ^= 0xff
+	return b64.EncodeToString(decoded)
+}
+
+func TestWrongKeyType(t *testing.T) {
+	rsaKey, ecKey := keys(t)["rsa"], keys(t)["ec"]
+
+	if _, err := Decrypt(ecKey, encrypt(t, rsaKey, `{"name":"Alice"}`)); err == nil {
+		t.Fatal("RSA-OAEP-256 envelope decrypted with an EC key")
+	}
+	if _, err := Decrypt(rsaKey, encrypt(t, ecKey, `{"name":"Alice"}`)); err == nil {
+		t.Fatal("ECDH-ES envelope decrypted with an RSA key")
+	}
+
+	// the kid matches, but the alg isn't the one for the receiver's key type
+	env := encrypt(t, ecKey, `{"name":"Alice"}`)
+	env.Alg, env.Epk, env.EncryptedKey = AlgRSAOAEP256, "", b64.EncodeToString(make([]byte, 256))
+	if err := env.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.CheckRecipient(publicPEM(t, ecKey)); err == nil {
+		t.Fatal("RSA-OAEP-256 accepted for an EC key")
+	}
+	env = encrypt(t, rsaKey, `{"name":"Alice"}`)
+	env.Alg, env.EncryptedKey, env.Epk = AlgECDHES, "", b64.EncodeToString(make([]byte, epkSize))
+	if err := env.CheckRecipient(publicPEM(t, rsaKey)); err == nil {
+		t.Fatal("ECDH-ES accepted for an RSA key")
+	}
+
+	// an envelope for another key
+	if err := encrypt(t, rsaKey, `{}`).CheckRecipient(publicPEM(t, ecKey)); err == nil {
+		t.Fatal("envelope accepted for another key")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		change func(*Envelope)
+	}{
+		{"missing kid", "ec", func(e *Envelope) { e.Kid = "" }},
+		{"unsupported enc", "ec", func(e *Envelope) { e.Enc = "A128GCM" }},
+		{"unsupported alg", "ec", func(e *Envelope) { e.Alg = "dir" }},
+		{"short iv", "ec", func(e *Envelope) { e.Iv = b64.EncodeToString(make([]byte, ivSize-1)) }},
+		{"long iv", "rsa", func(e *Envelope) { e.Iv = b64.EncodeToString(make([]byte, ivSize+1)) }},
+		{"short tag", "ec", func(e *Envelope) { e.Tag = b64.EncodeToString(make([]byte, tagSize-1)) }},
+		{"long tag", "rsa", func(e *Envelope) { e.Tag = b64.EncodeToString(make([]byte, tagSize+1)) }},
+		{"short epk", "ec", func(e *Envelope) { e.Epk = b64.EncodeToString(make([]byte, epkSize-1)) }},
+		{"missing epk", "ec", func(e *Envelope) { e.Epk = "" }},
+		{"missing encrypted_key", "rsa", func(e *Envelope) { e.EncryptedKey = "" }},
+		{"encrypted_key with ECDH-ES", "ec", func(e *Envelope) { e.EncryptedKey = e.Tag }},
+		{"epk with RSA-OAEP-256", "rsa", func(e *Envelope) { e.Epk = b64.EncodeToString(make([]byte, epkSize)) }},
+		{"missing ciphertext", "rsa", func(e *Envelope) { e.Ciphertext = "" }},
+		{"padded base64", "ec", func(e *Envelope) { e.Iv += "=" }},
+		{"standard base64", "ec", func(e *Envelope) { e.Tag = strings.Repeat("+", 22) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := encrypt(t, keys(t)[test.key], `{"name":"Alice"}`)
+			if err := env.Validate(); err != nil {
+				t.Fatalf("valid envelope refused: %v", err)
+			}
+			test.change(env)
+			if err := env.Validate(); err == nil {
+				t.Fatalf("accepted %+v", env)
+			}
+			data, _ := json.Marshal(env)
+			if _, err := Parse(data); err == nil {
+				t.Fatalf("parsed %s", data)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte(`"not an envelope"`)); err == nil {
+		t.Fatal("parsed a JSON string")
+	}
+}
@@ -0,0 +1,136 @@
+// Package events decodes the chaincode events the consent form chaincode emits when customer data,
+// crossrefs or entities change, so that receivers can learn about new data without polling.
+//
+// The peer keeps a single chaincode event per transaction, so the chaincode emits one event named Name
+// per transaction that changed anything. Its payload is a Batch of every change the transaction made,
+// in the order it made them:
+//
+//	{
+//	  "events": [
+//	    {"event_type": "data_registered", "customer_id": "c1", "sender_id": "bank1", "receiver_id": "bank2", "version": 2, "tx_id": "..."},
+//	    ...
+//	  ]
+//	}
+//
+// Events tell what changed, never the customer data Content itself: a receiver reads the data it is told
+// about with access_customer and get_customer_content.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Name is the name of every chaincode event the chaincode emits.
+const Name = "consent_form"
+
+// Event types.
+const (
+	DataRegistered     = "data_registered"     // customer data was registered, or re-submitted as a new version
+	DataDeleted        = "data_deleted"        // customer data was deleted, by its sender or because consent ended
+	CrossrefRegistered = "crossref_registered" // an entity registered its reference for a customer
+	CrossrefDeleted    = "crossref_deleted"    // an entity's reference for a customer was deleted
+	EntityRegistered   = "entity_registered"   // an entity was registered or its record changed
+	EntityKeyRotated   = "entity_key_rotated"  // an entity rotated its public key
+	EntityDeleted      = "entity_deleted"      // an entity was deleted
+)
+
+// Event is one change made by a transaction. Which IDs are set depends on Type: data events have
+// CustomerId, SenderId and ReceiverId, crossref events CustomerId and EntityId, entity events EntityId.
+// Version is the version a DataRegistered event wrote.
+type Event struct {
+	Type       string `json:"event_type"`
+	CustomerId string `json:"customer_id,omitempty"`
+	SenderId   string `json:"sender_id,omitempty"`
+	ReceiverId string `json:"receiver_id,omitempty"`
+	EntityId   string `json:"entity_id,omitempty"`
+	Version    int    `json:"version,omitempty"`
+	TxId       string `json:"tx_id"`
+}
+
+// Batch is the payload of a chaincode event: the changes made by one transaction.
+type Batch struct {
+	Events []Event `json:"events"`
+}
+
+// Decode decodes the payload of a chaincode event named Name. Event types it doesn't know are kept, so
+// that listeners built against an older version of this package keep working.
+func Decode(payload []byte) ([]Event, error) {
+	var batch Batch
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, errors.New("events: not a JSON event batch: " + err.Error())
+	}
+	for _, event := range batch.Events {
+		if event.Type == "" || event.TxId == "" {
+			return nil, errors.New("events: event without event_type or tx_id")
+		}
+	}
+	return batch.Events, nil
+}
+
+// Raw is a chaincode event as delivered by the peer, e.g. copied from a fabric-gateway client.ChaincodeEvent.
+type Raw struct {
+	TransactionID string
+	EventName     string
+	Payload       []byte
+}
+
+// Handler is called for each decoded event. An error stops Run.
+type Handler func(Event) error
+
+// Listener decodes raw chaincode events and calls the handlers registered for their types.
+type Listener struct {
+	handlers map[string][]Handler
+}
+
+// NewListener returns a Listener without handlers.
+func NewListener() *Listener {
+	return &Listener{handlers: map[string][]Handler{}}
+}
+
+// On registers handler for events of eventType, or for every event if eventType is "". Handlers are
+// called in the order they were registered, those for every event first.
+func (l *Listener) On(eventType string, handler Handler) {
+	l.handlers[eventType] = append(l.handlers[eventType], handler)
+}
+
+// Handle decodes raw and calls the handlers for each of its events in order. Events with another name
+// than Name are ignored.
+func (l *Listener) Handle(raw Raw) error {
+	if raw.EventName != Name {
+		return nil
+	}
+	events, err := Decode(raw.Payload)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		for _, eventType := range []string{"", event.Type} {
+			for _, handler := range l.handlers[eventType] {
+				if err := handler(event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Run handles the events received from source until it is closed, ctx is done or a handler fails.
+// It returns nil once source is closed.
+func (l *Listener) Run(ctx context.Context, source <-chan Raw) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case raw, ok := <-source:
+			if !ok {
+				return nil
+			}
+			if err := l.Handle(raw); err != nil {
+				return err
+			}
+		}
+	}
+}
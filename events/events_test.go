@@ -0,0 +1,132 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	events, err := Decode([]byte(`{"events":[
+		{"event_type":"data_registered","customer_id":"c1","sender_id":"bank1","receiver_id":"bank2","version":2,"tx_id":"tx1"},
+		{"event_type":"customer_merged","customer_id":"c1","tx_id":"tx1"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Type: DataRegistered, CustomerId: "c1", SenderId: "bank1", ReceiverId: "bank2", Version: 2, TxId: "tx1"},
+		// types added to the chaincode later are kept
+		{Type: "customer_merged", CustomerId: "c1", TxId: "tx1"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("got %+v, want %+v", events[i], want[i])
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for name, payload := range map[string]string{
+		"not JSON":           `events`,
+		"without event_type": `{"events":[{"customer_id":"c1","tx_id":"tx1"}]}`,
+		"without tx_id":      `{"events":[{"event_type":"data_deleted","customer_id":"c1"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if events, err := Decode([]byte(payload)); err == nil {
+				t.Fatalf("decoded %+v", events)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var got []string
+	listener := NewListener()
+	record := func(name string) Handler {
+		return func(event Event) error {
+			got = append(got, name+" "+event.Type)
+			return nil
+		}
+	}
+	// handlers for every event run first, whatever the order they were registered in
+	listener.On(DataDeleted, record("deleted"))
+	listener.On("", record("all"))
+	listener.On(DataRegistered, record("registered"))
+
+	payload := []byte(`{"events":[{"event_type":"data_registered","tx_id":"tx1"},{"event_type":"data_deleted","tx_id":"tx1"}]}`)
+	if err := listener.Handle(Raw{TransactionID: "tx1", EventName: "other", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("handled an event of another name: %v", got)
+	}
+
+	if err := listener.Handle(Raw{TransactionID: "tx1", EventName: Name, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	want := "all data_registered,registered data_registered,all data_deleted,deleted data_deleted"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+
+	if err := listener.Handle(Raw{TransactionID: "tx2", EventName: Name, Payload: []byte(`{"events":[{"tx_id":"tx2"}]}`)}); err == nil {
+		t.Fatal("handled an invalid payload")
+	}
+}
+
+func TestHandleError(t *testing.T) {
+	failed := errors.New("failed")
+	calls := 0
+	listener := NewListener()
+	listener.On("", func(event Event) error {
+		calls++
+		return failed
+	})
+	payload := []byte(`{"events":[{"event_type":"data_registered","tx_id":"tx1"},{"event_type":"data_deleted","tx_id":"tx1"}]}`)
+	if err := listener.Handle(Raw{EventName: Name, Payload: payload}); err != failed || calls != 1 {
+		t.Fatalf("got %v after %d calls", err, calls)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var got []string
+	listener := NewListener()
+	listener.On("", func(event Event) error {
+		got = append(got, event.TxId)
+		return nil
+	})
+
+	// returns nil once the source is closed, after handling what it delivered
+	source := make(chan Raw, 2)
+	source <- Raw{TransactionID: "tx1", EventName: Name, Payload: []byte(`{"events":[{"event_type":"data_registered","tx_id":"tx1"}]}`)}
+	source <- Raw{TransactionID: "tx2", EventName: Name, Payload: []byte(`{"events":[{"event_type":"data_deleted","tx_id":"tx2"}]}`)}
+	close(source)
+	if err := listener.Run(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "tx1,tx2" {
+		t.Fatalf("got %v", got)
+	}
+
+	// returns the context's error once it is done, even while the source stays open
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- listener.Run(ctx, make(chan Raw))
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}